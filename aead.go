@@ -0,0 +1,266 @@
+package hacket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sealedFrameHeaderSize is the size of the frame header and key ID at the start
+// of a sealed frame. The nonce chosen by the cipher follows the header
+const sealedFrameHeaderSize = frameHeaderSize + 4
+
+const (
+	// keyringSealOverhead is the most the Keyring adds to a message: the sealed
+	// frame header, the largest nonce, the authentication tag and the replay header
+	keyringSealOverhead = sealedFrameHeaderSize + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead + replayHeaderSize
+	// maxSealOverhead is the most seal adds to a message. The Keyring adds more
+	// than a Noise session
+	maxSealOverhead = keyringSealOverhead
+)
+
+// Cipher is an AEAD algorithm used to seal packets
+type Cipher uint8
+
+const (
+	// CipherAES256GCM is AES-256 in GCM mode with a random 96 bit nonce
+	CipherAES256GCM Cipher = iota + 1
+	// CipherChaCha20Poly1305 is ChaCha20-Poly1305 with a random 96 bit nonce
+	CipherChaCha20Poly1305
+	// CipherXChaCha20Poly1305 is ChaCha20-Poly1305 with a random 192 bit nonce.
+	// The larger nonce allows far more packets to be sealed with a single key
+	CipherXChaCha20Poly1305
+)
+
+// String returns the name of the Cipher
+func (c Cipher) String() string {
+	switch c {
+	case CipherAES256GCM:
+		return "AES-256-GCM"
+	case CipherChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case CipherXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("Cipher(%d)", uint8(c))
+	}
+}
+
+// newAEAD creates the AEAD for c with a 32 byte key
+func (c Cipher) newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKeySize
+	}
+	switch c {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, ErrUnknownCipher
+	}
+}
+
+// Keyring holds the pre-shared keys used to seal and open packets. Every key
+// has an ID that is sent with each packet so the receiver can pick the key to
+// open it with. Packets are sealed with the primary key.
+//
+// Keys are rotated without downtime by adding the new key to every peer,
+// making it the primary key on every peer and finally removing the old key
+// once no packets sealed with it are in flight.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[uint32]cipher.AEAD
+	primary uint32
+	// hasPrimary is false until a primary key is set
+	hasPrimary bool
+}
+
+// NewKeyring creates an empty Keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// AddKey adds a 32 byte key with id for c. The first key added becomes the
+// primary key. ErrKeyAlreadyExists is returned when id is already in use
+func (k *Keyring) AddKey(id uint32, c Cipher, key []byte) error {
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; ok {
+		return ErrKeyAlreadyExists
+	}
+	k.keys[id] = aead
+	if !k.hasPrimary {
+		k.primary = id
+		k.hasPrimary = true
+	}
+	return nil
+}
+
+// SetPrimary sets the key used to seal packets. ErrKeyNotFound is returned
+// when no key with id has been added
+func (k *Keyring) SetPrimary(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	k.primary = id
+	k.hasPrimary = true
+	return nil
+}
+
+// RemoveKey removes the key with id. Packets sealed with it can no longer be
+// opened. The primary key cannot be removed
+func (k *Keyring) RemoveKey(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	if k.hasPrimary && k.primary == id {
+		return ErrPrimaryKey
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// primaryKey returns the ID and AEAD of the primary key
+func (k *Keyring) primaryKey() (uint32, cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if !k.hasPrimary {
+		return 0, nil, ErrKeyNotFound
+	}
+	return k.primary, k.keys[k.primary], nil
+}
+
+// key returns the AEAD for id
+func (k *Keyring) key(id uint32) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[id]
+	return aead, ok
+}
+
+// seal encrypts and authenticates prefix followed by b with the primary key.
+// The frame header is authenticated as additional data
+func (k *Keyring) seal(prefix []byte, b []byte) ([]byte, error) {
+	id, aead, err := k.primaryKey()
+	if err != nil {
+		return nil, err
+	}
+	headerSize := sealedFrameHeaderSize + aead.NonceSize()
+	frame := make([]byte, headerSize, headerSize+len(prefix)+len(b)+aead.Overhead())
+	putFrameHeader(frame, frameSealed)
+	binary.BigEndian.PutUint32(frame[frameHeaderSize:sealedFrameHeaderSize], id)
+	nonce := frame[sealedFrameHeaderSize:headerSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plaintext := append(append(frame, prefix...), b...)[headerSize:]
+	// the ciphertext overwrites the plaintext in place
+	return aead.Seal(frame, nonce, plaintext, frame[:sealedFrameHeaderSize]), nil
+}
+
+// open authenticates and decrypts a sealed frame in place
+func (k *Keyring) open(b []byte) ([]byte, error) {
+	if ft, ok := frameOf(b); !ok || ft != frameSealed || len(b) < sealedFrameHeaderSize {
+		return nil, ErrUnauthenticated
+	}
+	aead, ok := k.key(binary.BigEndian.Uint32(b[frameHeaderSize:sealedFrameHeaderSize]))
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	headerSize := sealedFrameHeaderSize + aead.NonceSize()
+	if len(b) < headerSize+aead.Overhead() {
+		return nil, ErrUnauthenticated
+	}
+	ciphertext := b[headerSize:]
+	plaintext, err := aead.Open(ciphertext[:0], b[sealedFrameHeaderSize:headerSize], ciphertext, b[:sealedFrameHeaderSize])
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return plaintext, nil
+}
+
+// seal encrypts b for addr. Messages to a peer with a Noise session are
+// encrypted for the session, otherwise they are sealed with the Keyring when
+// one is configured. Sealed messages are preceded by the endpoint's replay header
+func (ep *endpoint) seal(b []byte, addr net.Addr) ([]byte, error) {
+	if ep.noise != nil {
+		if s := ep.noise.session(addr); s != nil {
+			return s.seal(b)
+		}
+		if ep.options.Keyring == nil && !ep.noise.config.AllowPlaintext {
+			return nil, ErrNoiseSessionRequired
+		}
+	}
+	if ep.options.Keyring == nil {
+		return b, nil
+	}
+	var header [replayHeaderSize]byte
+	ep.replay.next(header[:], time.Now())
+	return ep.options.Keyring.seal(header[:], b)
+}
+
+// sealOverhead returns the most seal adds to a message written by the endpoint
+func (ep *endpoint) sealOverhead() int {
+	overhead := 0
+	if ep.options.Keyring != nil {
+		overhead = keyringSealOverhead
+	}
+	if ep.noise != nil && overhead < noiseSealOverhead {
+		overhead = noiseSealOverhead
+	}
+	return overhead
+}
+
+// open decrypts a received packet when a Keyring or Noise is configured.
+// Packets that cannot be authenticated or that are replayed are dropped
+func (ep *endpoint) open(packet Packet) (Packet, bool) {
+	if ep.noise != nil {
+		if ft, ok := frameOf(packet.Msg()); ok && ft == frameNoise {
+			return ep.receiveNoise(packet)
+		}
+		if ep.options.Keyring == nil && !ep.noise.config.AllowPlaintext {
+			ep.mon.logger.Log(LevelDebug, "plaintext packet without a noise session", "from", packet.FromAddr())
+			ep.mon.drops.drop(packet, DropReasonUnauthenticated)
+			return packet, false
+		}
+	}
+	if ep.options.Keyring == nil {
+		return packet, true
+	}
+	msg, err := ep.options.Keyring.open(packet.Msg())
+	if err != nil {
+		ep.mon.logger.Log(LevelDebug, "unauthenticated packet", "from", packet.FromAddr(), "err", err)
+		ep.mon.drops.drop(packet, DropReasonUnauthenticated)
+		return packet, false
+	}
+	body, reason, err := ep.replay.accept(msg, packet.Timestamp(), ep.options.ReplayMaxAge)
+	if err != nil {
+		ep.mon.logger.Log(LevelDebug, "replayed packet", "from", packet.FromAddr(), "err", err)
+		ep.mon.drops.drop(packet, reason)
+		return packet, false
+	}
+	packet.SetMsg(body)
+	return packet, true
+}
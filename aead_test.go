@@ -0,0 +1,131 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	for _, c := range []Cipher{CipherAES256GCM, CipherChaCha20Poly1305, CipherXChaCha20Poly1305} {
+		keyring := NewKeyring()
+		if err := keyring.AddKey(1, c, testKey(1)); err != nil {
+			t.Fatal(c, "error adding key:", err)
+		}
+		sealed, err := keyring.seal(nil, []byte("secret"))
+		if err != nil {
+			t.Fatal(c, "error sealing:", err)
+		}
+		if bytes.Contains(sealed, []byte("secret")) {
+			t.Error(c, "expected sealed frame not to contain the plaintext")
+		}
+		tampered := append([]byte(nil), sealed...)
+		tampered[len(tampered)-1] ^= 0x01
+		if _, err := keyring.open(tampered); err != ErrUnauthenticated {
+			t.Error(c, "expected tampered frame to be rejected got", err)
+		}
+		opened, err := keyring.open(sealed)
+		if err != nil || string(opened) != "secret" {
+			t.Errorf("%s expected secret got %q %v", c, opened, err)
+		}
+	}
+}
+
+func TestKeyringManagement(t *testing.T) {
+	keyring := NewKeyring()
+	if _, err := keyring.seal(nil, []byte("msg")); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound without keys got", err)
+	}
+	if err := keyring.AddKey(1, CipherAES256GCM, []byte("short")); err != ErrInvalidKeySize {
+		t.Error("Expected ErrInvalidKeySize got", err)
+	}
+	if err := keyring.AddKey(1, Cipher(99), testKey(1)); err != ErrUnknownCipher {
+		t.Error("Expected ErrUnknownCipher got", err)
+	}
+	keyring.AddKey(1, CipherAES256GCM, testKey(1))
+	if err := keyring.AddKey(1, CipherAES256GCM, testKey(1)); err != ErrKeyAlreadyExists {
+		t.Error("Expected ErrKeyAlreadyExists got", err)
+	}
+	if err := keyring.RemoveKey(1); err != ErrPrimaryKey {
+		t.Error("Expected ErrPrimaryKey got", err)
+	}
+	if err := keyring.SetPrimary(2); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound got", err)
+	}
+}
+
+func TestSealedServe(t *testing.T) {
+	serverKeys := NewKeyring()
+	serverKeys.AddKey(1, CipherChaCha20Poly1305, testKey(1))
+	serverKeys.AddKey(2, CipherAES256GCM, testKey(2))
+	dropped := make(chan DropReason, 4)
+	server, _, err := New("udp", "127.0.0.1:0", WithKeyring(serverKeys), WithDropHandler(func(packet Packet, reason DropReason) {
+		dropped <- reason
+	}))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go server.Serve(mux)
+
+	// the caller has rotated to key 2 which the server also holds
+	callerKeys := NewKeyring()
+	callerKeys.AddKey(1, CipherChaCha20Poly1305, testKey(1))
+	callerKeys.AddKey(2, CipherAES256GCM, testKey(2))
+	callerKeys.SetPrimary(2)
+	caller, client, err := New("udp", "127.0.0.1:0", WithKeyring(callerKeys))
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, _ := NewPacketMessageBuilder([]byte("sealed")).WithPacketType(echoType).Build()
+	reply, err := client.(Caller).Call(ctx, msg, server.Addr())
+	if err != nil {
+		t.Fatal("Error calling sealed server:", err)
+	}
+	if string(reply.Msg()) != "sealed" {
+		t.Errorf("Expected sealed got %q", reply.Msg())
+	}
+	reply.Release()
+	if err := client.(ReliableWriter).WriteReliable(ctx, msg, server.Addr()); err != nil {
+		t.Error("Error writing reliably to sealed server:", err)
+	}
+
+	// plaintext and packets sealed with unknown keys are dropped
+	plain, plainClient, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating plaintext client:", err)
+	}
+	defer plain.Shutdown(context.Background())
+	plainClient.WriteTo(msg, server.Addr())
+	otherKeys := NewKeyring()
+	otherKeys.AddKey(3, CipherAES256GCM, testKey(3))
+	sealed, _ := otherKeys.seal(nil, msg)
+	plainClient.WriteTo(sealed, server.Addr())
+	for i := 0; i < 2; i++ {
+		select {
+		case reason := <-dropped:
+			if reason != DropReasonUnauthenticated {
+				t.Error("Expected unauthenticated drop got", reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for drop")
+		}
+	}
+	if stats := server.Stats(); stats.Dropped[DropReasonUnauthenticated] != 2 {
+		t.Error("Expected 2 unauthenticated drops got", stats.Dropped[DropReasonUnauthenticated])
+	}
+}
@@ -0,0 +1,156 @@
+package hacket
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// BatchMessage is a PacketMessage and the address it is written to by WriteBatch.
+// When Ctx carries a SpanContext it is propagated to the peer as it is by
+// WriteToContext. Messages with a nil Ctx start a new trace at the peer
+type BatchMessage struct {
+	Msg  PacketMessage
+	Addr net.Addr
+	Ctx  context.Context
+}
+
+// tracedMsg returns the message of m wrapped in a trace frame when its context
+// carries a SpanContext
+func (m BatchMessage) tracedMsg() PacketMessage {
+	if m.Ctx == nil {
+		return m.Msg
+	}
+	msg, _ := traced(m.Ctx, m.Msg)
+	return msg
+}
+
+// batchConn reads and writes several datagrams per call. On Linux each call
+// is a single recvmmsg or sendmmsg system call, other platforms transfer one
+// datagram per system call. ipv4.PacketConn and ipv6.PacketConn implement it
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+var (
+	_ batchConn = &ipv4.PacketConn{}
+	_ batchConn = &ipv6.PacketConn{}
+)
+
+// newBatchConn returns a batchConn for UDP connections. Other connections
+// can not be batched and return false
+func newBatchConn(conn net.PacketConn) (batchConn, bool) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(udpConn), true
+	}
+	return ipv6.NewPacketConn(udpConn), true
+}
+
+// writeBatch writes every message to its address, using as few system calls
+// as the connection allows. The number of messages written is returned
+func (ep *endpoint) writeBatch(msgs []BatchMessage) (int, error) {
+	if ep.batch == nil {
+		for i, m := range msgs {
+			if _, err := ep.writeTo(m.tracedMsg(), m.Addr); err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+	if ep.options.WriteDeadline > 0 {
+		deadline := time.Now().Add(ep.options.WriteDeadline)
+		if err := ep.conn.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	// queue contiguous runs of messages that fit in a single datagram and
+	// flush them before writing a message that must be fragmented
+	datagrams := make([]ipv4.Message, 0, len(msgs))
+	written := 0
+	flush := func() error {
+		for len(datagrams) > 0 {
+			n, err := ep.batch.WriteBatch(datagrams, 0)
+			written += n
+			for _, datagram := range datagrams[:n] {
+				ep.mon.sent(datagram.N, nil)
+			}
+			if err != nil {
+				ep.mon.sent(0, err)
+				return err
+			}
+			if n == 0 {
+				// the connection made no progress, write the next datagram on
+				// its own rather than retrying the batch indefinitely
+				if _, err := ep.writeRaw(datagrams[0].Buffers[0], datagrams[0].Addr); err != nil {
+					return err
+				}
+				n = 1
+				written++
+			}
+			datagrams = datagrams[n:]
+		}
+		datagrams = datagrams[:0]
+		return nil
+	}
+	for _, m := range msgs {
+		msg := m.tracedMsg()
+		if ep.options.FragmentSize > 0 && len(msg)+ep.sealOverhead() > ep.options.FragmentSize {
+			if err := flush(); err != nil {
+				return written, err
+			}
+			if _, err := ep.writeFragmented(msg, m.Addr); err != nil {
+				return written, err
+			}
+			written++
+			continue
+		}
+		datagram, err := ep.seal(msg, m.Addr)
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return written, flushErr
+			}
+			return written, err
+		}
+		datagrams = append(datagrams, ipv4.Message{Buffers: [][]byte{datagram}, Addr: m.Addr})
+	}
+	if err := flush(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// serveBatch reads up to BatchSize datagrams per call until the server is shut down
+func (ps *packetServerImpl) serveBatch(deliveries dispatcher) error {
+	msgs := make([]ipv4.Message, ps.options.BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, udpPacketBufSize)}
+	}
+	for {
+		if ps.shutdown.isSet() {
+			return ErrPacketServiceShutdown
+		}
+		ps.setReadDeadline()
+		n, err := ps.ep.batch.ReadBatch(msgs, 0) // blocks until receive
+		if err != nil {
+			if ps.shutdown.isSet() {
+				return ErrPacketServiceShutdown
+			}
+			if ps.ep.mon.readError(err) {
+				return err
+			}
+			continue
+		}
+		ts := time.Now()
+		for _, msg := range msgs[:n] {
+			ps.receive(msg.Buffers[0][:msg.N], msg.Addr, ts, deliveries)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package hacket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestWriteBatchServeBatch(t *testing.T) {
+	const count = 50
+	receiver, _, err := New("udp", "127.0.0.1:0", WithBatchSize(16), WithConcurrencyLimit(4), WithFragmentation(1200))
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer receiver.Shutdown(context.Background())
+
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	done := make(chan struct{})
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[string(packet.Msg()[:8])] = true
+		if len(received) == count {
+			close(done)
+		}
+	})
+	go receiver.Serve(mux)
+
+	sender, client, err := New("udp", "127.0.0.1:0", WithFragmentation(1200))
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer sender.Shutdown(context.Background())
+
+	msgs := make([]BatchMessage, count)
+	for i := range msgs {
+		body := []byte(fmt.Sprintf("msg-%04d", i))
+		if i%10 == 0 {
+			// every tenth message must be fragmented
+			body = append(body, make([]byte, 3000)...)
+		}
+		msg, _ := NewPacketMessageBuilder(body).WithPacketType(PacketType(1)).Build()
+		msgs[i] = BatchMessage{Msg: msg, Addr: receiver.Addr()}
+	}
+	n, err := client.(BatchWriter).WriteBatch(msgs)
+	if err != nil {
+		t.Fatal("Error writing batch:", err)
+	}
+	if n != count {
+		t.Errorf("Expected %d messages written, wrote %d", count, n)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("Timed out waiting for batch, received %d of %d", len(received), count)
+	}
+}
+
+// stalledBatchConn is a batchConn that never writes a datagram
+type stalledBatchConn struct{}
+
+func (stalledBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) { return 0, nil }
+
+func (stalledBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) { return 0, nil }
+
+func TestWriteBatchNoProgress(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer conn.Close()
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer receiver.Close()
+
+	ep, err := newEndpoint(conn, defaultPacketOption())
+	if err != nil {
+		t.Fatal("Error creating endpoint:", err)
+	}
+	ep.batch = stalledBatchConn{}
+	msg, _ := NewPacketMessageBuilder([]byte("stalled")).WithPacketType(PacketType(1)).Build()
+	msgs := []BatchMessage{{Msg: msg, Addr: receiver.LocalAddr()}, {Msg: msg, Addr: receiver.LocalAddr()}}
+	written := make(chan int, 1)
+	go func() {
+		n, _ := ep.writeBatch(msgs)
+		written <- n
+	}()
+	select {
+	case n := <-written:
+		if n != len(msgs) {
+			t.Errorf("Expected %d messages written, wrote %d", len(msgs), n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteBatch did not return when the batch made no progress")
+	}
+	buf := make([]byte, 64)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := receiver.ReadFrom(buf); err != nil || string(buf[1:n]) != "stalled" {
+		t.Errorf("Expected stalled message to be written on its own, received %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,72 @@
+package hacket
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// minBufferClassSize is the capacity of the smallest pooled buffer
+	minBufferClassSize = 64
+	// bufferClasses is the number of pooled buffer sizes. Each class is double
+	// the size of the previous so the largest class holds udpPacketBufSize bytes
+	bufferClasses = 11
+)
+
+// packetBuffer is a reference counted buffer holding the bytes of a received
+// datagram. The buffer is returned to its pool when the last reference is released
+type packetBuffer struct {
+	b     []byte
+	refs  int32
+	class int
+}
+
+// bufferPools holds a sync.Pool for each buffer class
+var bufferPools [bufferClasses]sync.Pool
+
+func init() {
+	for i := range bufferPools {
+		size := minBufferClassSize << uint(i)
+		class := i
+		bufferPools[i].New = func() interface{} {
+			return &packetBuffer{b: make([]byte, size), class: class}
+		}
+	}
+}
+
+// bufferClass returns the smallest buffer class that holds n bytes
+func bufferClass(n int) int {
+	class := 0
+	for size := minBufferClassSize; size < n && class < bufferClasses-1; size <<= 1 {
+		class++
+	}
+	return class
+}
+
+// getBuffer returns a pooled buffer holding a copy of b with a single reference
+func getBuffer(b []byte) *packetBuffer {
+	class := bufferClass(len(b))
+	if len(b) > minBufferClassSize<<uint(class) {
+		// larger than any class, fall back to an unpooled buffer
+		return &packetBuffer{b: append([]byte(nil), b...), refs: 1, class: -1}
+	}
+	pb := bufferPools[class].Get().(*packetBuffer)
+	pb.b = pb.b[:len(b)]
+	copy(pb.b, b)
+	pb.refs = 1
+	return pb
+}
+
+// retain adds a reference to the buffer
+func (pb *packetBuffer) retain() {
+	atomic.AddInt32(&pb.refs, 1)
+}
+
+// release removes a reference and returns the buffer to its pool when it was the last one
+func (pb *packetBuffer) release() {
+	if atomic.AddInt32(&pb.refs, -1) != 0 || pb.class < 0 {
+		return
+	}
+	pb.b = pb.b[:cap(pb.b)]
+	bufferPools[pb.class].Put(pb)
+}
@@ -0,0 +1,269 @@
+package hacket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+const (
+	// callFrameHeaderSize is the size of the frame type and correlation ID
+	// prepended to call requests and responses
+	callFrameHeaderSize = frameHeaderSize + 8
+	// maxFinishedCalls bounds the number of completed calls remembered so
+	// their late replies can be told apart from forged ones
+	maxFinishedCalls = 1024
+)
+
+// callKey identifies a call waiting for a reply. Only the peer the request was
+// sent to can reply to it
+type callKey struct {
+	id   uint64
+	addr string
+}
+
+// callRegistry tracks calls that are waiting for a reply. Correlation IDs are
+// random so that replies cannot be forged by hosts that do not see the requests
+type callRegistry struct {
+	mu       sync.Mutex
+	pending  map[callKey]chan Packet
+	finished map[callKey]struct{}
+	order    []callKey // finished calls oldest first
+	closed   bool
+}
+
+func newCallRegistry() *callRegistry {
+	return &callRegistry{
+		pending:  make(map[callKey]chan Packet),
+		finished: make(map[callKey]struct{}),
+	}
+}
+
+// register allocates a correlation ID for a call to addr and the channel its
+// reply is delivered on
+func (cr *callRegistry) register(addr net.Addr) (callKey, <-chan Packet, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.closed {
+		return callKey{}, nil, ErrPacketServiceShutdown
+	}
+	key := callKey{addr: addrKey(addr)}
+	var id [8]byte
+	for {
+		if _, err := rand.Read(id[:]); err != nil {
+			return callKey{}, nil, err
+		}
+		key.id = binary.BigEndian.Uint64(id[:])
+		if _, ok := cr.pending[key]; !ok && key.id != 0 {
+			break
+		}
+	}
+	reply := make(chan Packet, 1)
+	cr.pending[key] = reply
+	return key, reply, nil
+}
+
+// cancel stops waiting for a reply to key
+func (cr *callRegistry) cancel(key callKey) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if _, ok := cr.pending[key]; ok {
+		cr.finish(key)
+	}
+}
+
+// finish forgets the pending call key and remembers that it completed. It
+// must be called with mu held
+func (cr *callRegistry) finish(key callKey) {
+	delete(cr.pending, key)
+	if len(cr.order) >= maxFinishedCalls {
+		delete(cr.finished, cr.order[0])
+		cr.order = cr.order[1:]
+	}
+	cr.finished[key] = struct{}{}
+	cr.order = append(cr.order, key)
+}
+
+// resolve delivers packet to the call waiting on id that was sent to the
+// address packet came from. ErrLateReply is returned when the call already
+// completed or was cancelled and ErrUnmatchedReply when no call with id was
+// sent to that address.
+func (cr *callRegistry) resolve(id uint64, packet Packet) error {
+	key := callKey{id: id, addr: addrKey(packet.FromAddr())}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	reply, ok := cr.pending[key]
+	if !ok {
+		if _, ok := cr.finished[key]; ok {
+			return ErrLateReply
+		}
+		return ErrUnmatchedReply
+	}
+	cr.finish(key)
+	// the reply outlives the server's handling of the packet
+	packet.Retain()
+	reply <- packet
+	return nil
+}
+
+// close fails all pending calls and rejects new ones
+func (cr *callRegistry) close() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.closed = true
+	for key, reply := range cr.pending {
+		close(reply)
+		delete(cr.pending, key)
+	}
+}
+
+// encodeCallFrame prepends a call frame header to msg
+func encodeCallFrame(ft frameType, id uint64, msg []byte) (PacketMessage, error) {
+	if msg == nil {
+		return nil, ErrNilByteSlice
+	}
+	frame := make([]byte, callFrameHeaderSize+len(msg))
+	putFrameHeader(frame, ft)
+	binary.BigEndian.PutUint64(frame[frameHeaderSize:callFrameHeaderSize], id)
+	copy(frame[callFrameHeaderSize:], msg)
+	return frame, nil
+}
+
+// decodeCallFrame returns the correlation ID and the message wrapped by a call frame
+func decodeCallFrame(b []byte) (uint64, PacketMessage, error) {
+	if len(b) < callFrameHeaderSize {
+		return 0, nil, ErrShortPacket
+	}
+	return binary.BigEndian.Uint64(b[frameHeaderSize:callFrameHeaderSize]), b[callFrameHeaderSize:], nil
+}
+
+// callPacketWriter is the PacketWriter handed to handlers of call requests.
+// Messages written back to the caller are stamped with the correlation ID of
+// the request so the reply is routed to the waiting Call.
+type callPacketWriter struct {
+	ep   *endpoint
+	id   uint64
+	addr net.Addr
+	// ctx is the context of the packet being handled by a traced PacketMux
+	ctx context.Context
+}
+
+var (
+	_ ContextWriter  = &callPacketWriter{}
+	_ ReliableWriter = &callPacketWriter{}
+	_ BatchWriter    = &callPacketWriter{}
+	_ contextBinder  = &callPacketWriter{}
+)
+
+// isCaller reports whether addr is the address the call request came from
+func (cpw *callPacketWriter) isCaller(addr net.Addr) bool {
+	return addr != nil && cpw.addr != nil && addr.String() == cpw.addr.String()
+}
+
+// WriteTo writes msg to addr. When addr is the caller the message is sent as
+// the reply to the call. Handlers of a PacketMux with a Tracer continue the
+// trace of the packet being handled.
+func (cpw *callPacketWriter) WriteTo(msg PacketMessage, addr net.Addr) (int, error) {
+	if cpw.ctx != nil {
+		return cpw.WriteToContext(cpw.ctx, msg, addr)
+	}
+	if !cpw.isCaller(addr) {
+		return cpw.ep.writeTo(msg, addr)
+	}
+	frame, err := encodeCallFrame(frameCallResponse, cpw.id, msg)
+	if err != nil {
+		return 0, err
+	}
+	n, err := cpw.ep.writeTo(frame, addr)
+	if n >= callFrameHeaderSize {
+		n -= callFrameHeaderSize
+	}
+	return n, err
+}
+
+// withContext statifies the contextBinder interface
+func (cpw *callPacketWriter) withContext(ctx context.Context) PacketWriter {
+	return &callPacketWriter{ep: cpw.ep, id: cpw.id, addr: cpw.addr, ctx: ctx}
+}
+
+// WriteToContext writes msg to addr propagating the SpanContext carried by ctx.
+// When addr is the caller the message is sent as the reply to the call.
+func (cpw *callPacketWriter) WriteToContext(ctx context.Context, msg PacketMessage, addr net.Addr) (int, error) {
+	if !cpw.isCaller(addr) {
+		return cpw.ep.writeToContext(ctx, msg, addr)
+	}
+	frame, err := encodeCallFrame(frameCallResponse, cpw.id, msg)
+	if err != nil {
+		return 0, err
+	}
+	n, err := cpw.ep.writeToContext(ctx, frame, addr)
+	if n >= callFrameHeaderSize {
+		n -= callFrameHeaderSize
+	}
+	return n, err
+}
+
+// WriteReliable writes msg to addr and waits for it to be acknowledged. When addr
+// is the caller the message is sent as the reply to the call.
+func (cpw *callPacketWriter) WriteReliable(ctx context.Context, msg PacketMessage, addr net.Addr) error {
+	if !cpw.isCaller(addr) {
+		return cpw.ep.writeReliable(ctx, msg, addr)
+	}
+	frame, err := encodeCallFrame(frameCallResponse, cpw.id, msg)
+	if err != nil {
+		return err
+	}
+	return cpw.ep.writeReliable(ctx, frame, addr)
+}
+
+// WriteBatch writes each message to its address. Messages written to the caller
+// are sent as replies to the call.
+func (cpw *callPacketWriter) WriteBatch(msgs []BatchMessage) (int, error) {
+	replies := make([]BatchMessage, len(msgs))
+	for i, m := range msgs {
+		replies[i] = m
+		if !cpw.isCaller(m.Addr) {
+			continue
+		}
+		frame, err := encodeCallFrame(frameCallResponse, cpw.id, m.Msg)
+		if err != nil {
+			return 0, err
+		}
+		replies[i].Msg = frame
+	}
+	return cpw.ep.writeBatch(replies)
+}
+
+// call sends msg to addr and waits for the handler on the remote peer to reply
+func (ep *endpoint) call(ctx context.Context, msg PacketMessage, addr net.Addr) (Packet, error) {
+	key, reply, err := ep.calls.register(addr)
+	if err != nil {
+		return Packet{}, err
+	}
+	frame, err := encodeCallFrame(frameCallRequest, key.id, msg)
+	if err != nil {
+		ep.calls.cancel(key)
+		return Packet{}, err
+	}
+	if _, err := ep.writeToContext(ctx, frame, addr); err != nil {
+		ep.calls.cancel(key)
+		return Packet{}, err
+	}
+	select {
+	case <-ctx.Done():
+		ep.calls.cancel(key)
+		return Packet{}, ctx.Err()
+	case packet, ok := <-reply:
+		if !ok {
+			return Packet{}, ErrPacketServiceShutdown
+		}
+		if IsErrorPacket(packet.Msg()) {
+			if pe, err := ParseErrorPacket(packet.Msg()); err == nil {
+				return packet, pe
+			}
+		}
+		return packet, nil
+	}
+}
@@ -0,0 +1,252 @@
+package hacket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	echoType PacketType = iota + 1
+	silentType
+)
+
+// newCallPair creates a serving peer that echos echoType packets and ignores
+// silentType packets along with a serving caller
+func newCallPair(t *testing.T, options ...Options) (PacketServer, PacketServer, PacketClient) {
+	t.Helper()
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		reply, _ := NewPacketMessageBuilder(packet.Msg()).WithPacketType(echoType).Build()
+		pw.WriteTo(reply, packet.FromAddr())
+	})
+	mux.PacketHandlerFunc(silentType, func(packet Packet, pw PacketWriter) {})
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0", options...)
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	go caller.Serve(NewPacketMux())
+	return peer, caller, client
+}
+
+func TestCall(t *testing.T) {
+	peer, caller, client := newCallPair(t)
+	defer peer.Shutdown(context.Background())
+	defer caller.Shutdown(context.Background())
+
+	for _, body := range []string{"one", "two", "three"} {
+		msg, _ := NewPacketMessageBuilder([]byte(body)).WithPacketType(echoType).Build()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reply, err := client.(Caller).Call(ctx, msg, peer.Addr())
+		cancel()
+		if err != nil {
+			t.Fatal("Error calling peer:", err)
+		}
+		pktType, replyBody, _ := decode(reply.Msg())
+		if pktType != echoType || string(replyBody) != body {
+			t.Errorf("Unexpected reply type %d body %q", pktType, replyBody)
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	peer, caller, client := newCallPair(t)
+	defer peer.Shutdown(context.Background())
+	defer caller.Shutdown(context.Background())
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(silentType).Build()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := client.(Caller).Call(ctx, msg, peer.Addr()); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded error, received:", err)
+	}
+}
+
+func TestCallShutdown(t *testing.T) {
+	peer, caller, client := newCallPair(t)
+	defer peer.Shutdown(context.Background())
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(silentType).Build()
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		caller.Shutdown(context.Background())
+	}()
+	if _, err := client.(Caller).Call(context.Background(), msg, peer.Addr()); err != ErrPacketServiceShutdown {
+		t.Fatal("Expected shutdown error, received:", err)
+	}
+}
+
+func TestCallLateReply(t *testing.T) {
+	lateReplies := make(chan error, 1)
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		time.Sleep(time.Millisecond * 100)
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0", WithUnmatchedReplyHandler(func(packet Packet, err error) {
+		lateReplies <- err
+	}))
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(echoType).Build()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := client.(Caller).Call(ctx, msg, peer.Addr()); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded error, received:", err)
+	}
+	select {
+	case err := <-lateReplies:
+		if err != ErrLateReply {
+			t.Error("Expected late reply error, received:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for late reply to be reported")
+	}
+}
+
+func TestCallRegistryUnmatched(t *testing.T) {
+	calls := newCallRegistry()
+	if err := calls.resolve(42, Packet{}); err != ErrUnmatchedReply {
+		t.Error("Expected unmatched reply error, received:", err)
+	}
+}
+
+func TestCallReplyFromOtherAddress(t *testing.T) {
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer peer.Close()
+	forger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer forger.Close()
+
+	unmatched := make(chan error, 1)
+	caller, client, err := New("udp", "127.0.0.1:0", WithUnmatchedReplyHandler(func(packet Packet, err error) {
+		unmatched <- err
+	}))
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	go func() {
+		buf := make([]byte, udpPacketBufSize)
+		n, addr, err := peer.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id, _, err := decodeCallFrame(buf[:n])
+		if err != nil {
+			return
+		}
+		// a reply from another host is not accepted even with the right ID
+		forged, _ := encodeCallFrame(frameCallResponse, id, []byte("forged"))
+		forger.WriteTo(forged, addr)
+		select {
+		case err := <-unmatched:
+			if err != ErrUnmatchedReply {
+				t.Error("Expected forged reply to be unmatched got", err)
+			}
+		case <-time.After(time.Second):
+			return
+		}
+		reply, _ := encodeCallFrame(frameCallResponse, id, []byte("real"))
+		peer.WriteTo(reply, addr)
+	}()
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(echoType).Build()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := client.(Caller).Call(ctx, msg, peer.LocalAddr())
+	if err != nil {
+		t.Fatal("Error calling peer:", err)
+	}
+	if string(reply.Msg()) != "real" {
+		t.Errorf("Expected real got %q", reply.Msg())
+	}
+	reply.Release()
+}
+
+func TestPacketHandlerHighPacketTypes(t *testing.T) {
+	server, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	// PacketTypes that share a byte with internal frame types reach handlers
+	received := make(chan PacketType, 2)
+	mux := NewPacketMux()
+	for _, pktType := range []PacketType{PacketType(frameCallRequest), PacketType(headerEscape)} {
+		pktType := pktType
+		if err := mux.PacketHandlerFunc(pktType, func(packet Packet, pw PacketWriter) {
+			received <- pktType
+		}); err != nil {
+			t.Fatal("Error registering handler:", err)
+		}
+	}
+	go server.Serve(mux)
+	for _, pktType := range []PacketType{PacketType(frameCallRequest), PacketType(headerEscape)} {
+		msg, _ := NewPacketMessageBuilder([]byte("high")).WithPacketType(pktType).Build()
+		client.WriteTo(msg, server.Addr())
+		select {
+		case got := <-received:
+			if got != pktType {
+				t.Errorf("Expected %d got %d", pktType, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for packet type", pktType)
+		}
+	}
+}
+
+func TestCallUnknownPacketType(t *testing.T) {
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.NotFoundHandler(UnknownPacketTypeHandler())
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(PacketType(42)).Build()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = client.(Caller).Call(ctx, msg, peer.Addr())
+	pe, ok := err.(*PacketError)
+	if !ok {
+		t.Fatal("Expected packet error, received:", err)
+	}
+	if pe.Code != ErrorCodeUnknownPacketType || pe.PacketType != PacketType(42) {
+		t.Errorf("Unexpected packet error %+v", pe)
+	}
+}
@@ -0,0 +1,193 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"net"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec marshals Go values to and from the body of a PacketMessage. Codecs for
+// other formats can be supplied by implementing Codec with the format's library
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values with encoding/json
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob. Every message carries its type
+	// description so gob is best suited to infrequent or large messages
+	GobCodec Codec = gobCodec{}
+	// ProtoCodec encodes values that implement ProtoMessage, such as messages
+	// generated by gogo/protobuf or vtprotobuf
+	ProtoCodec Codec = protoCodec{}
+	// CBORCodec encodes values with fxamacker/cbor
+	CBORCodec Codec = cborCodec{}
+	// MsgpackCodec encodes values as MessagePack with vmihailenco/msgpack
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string                               { return "cbor" }
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                               { return "msgpack" }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// ProtoMessage is implemented by protobuf messages that marshal themselves
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return msg.Marshal()
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(ProtoMessage)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return msg.Unmarshal(data)
+}
+
+// EncodePacketMessage marshals v with codec and prepends pktType
+func EncodePacketMessage(codec Codec, pktType PacketType, v interface{}) (PacketMessage, error) {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		// empty messages, such as a protobuf message with every field unset
+		b = []byte{}
+	}
+	return NewPacketMessageBuilder(b).WithPacketType(pktType).Build()
+}
+
+// WriteMessage marshals v with codec, prepends pktType and writes it to addr
+// with pw. The SpanContext carried by ctx is propagated to the peer when pw is
+// a ContextWriter
+func WriteMessage(ctx context.Context, pw PacketWriter, codec Codec, pktType PacketType, v interface{}, addr net.Addr) (int, error) {
+	msg, err := EncodePacketMessage(codec, pktType, v)
+	if err != nil {
+		return 0, err
+	}
+	if cw, ok := pw.(ContextWriter); ok {
+		return cw.WriteToContext(ctx, msg, addr)
+	}
+	return pw.WriteTo(msg, addr)
+}
+
+// DecodeErrorHandler is called when a typed handler cannot unmarshal a packet
+type DecodeErrorHandler func(packet Packet, pw PacketWriter, err error)
+
+var (
+	packetReflectType = reflect.TypeOf(Packet{})
+	writerReflectType = reflect.TypeOf((*PacketWriter)(nil)).Elem()
+)
+
+// typedHandler unmarshals packets into a new value of msgType before calling fn
+type typedHandler struct {
+	codec   Codec
+	fn      reflect.Value
+	msgType reflect.Type
+	onError func() DecodeErrorHandler
+}
+
+// NewTypedHandler returns a PacketHandler that unmarshals the message with codec
+// and calls fn with the decoded value. fn must be a function of the form
+//
+//	func(packet hacket.Packet, pw hacket.PacketWriter, msg *MyMessage)
+//
+// where the message parameter may be any pointer or value type. Packets that
+// cannot be unmarshalled are passed to onError. When onError is nil they are
+// reported as dropped with DropReasonMalformed
+func NewTypedHandler(codec Codec, fn interface{}, onError DecodeErrorHandler) (PacketHandler, error) {
+	handler, err := newTypedHandler(codec, fn, func() DecodeErrorHandler { return onError })
+	if err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+func newTypedHandler(codec Codec, fn interface{}, onError func() DecodeErrorHandler) (*typedHandler, error) {
+	if codec == nil {
+		return nil, ErrNilCodec
+	}
+	if fn == nil {
+		return nil, ErrNilPacketHander
+	}
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 3 || t.NumOut() != 0 ||
+		t.In(0) != packetReflectType || t.In(1) != writerReflectType {
+		return nil, ErrInvalidTypedHandler
+	}
+	return &typedHandler{codec: codec, fn: v, msgType: t.In(2), onError: onError}, nil
+}
+
+// HandlePacket statifies the PacketHandler interface
+func (th *typedHandler) HandlePacket(packet Packet, pw PacketWriter) {
+	var msg reflect.Value
+	if th.msgType.Kind() == reflect.Ptr {
+		msg = reflect.New(th.msgType.Elem())
+	} else {
+		msg = reflect.New(th.msgType)
+	}
+	if err := th.codec.Unmarshal(packet.Msg(), msg.Interface()); err != nil {
+		if onError := th.onError(); onError != nil {
+			onError(packet, pw, err)
+		} else {
+			packet.mon.malformed(packet, err)
+		}
+		return
+	}
+	if th.msgType.Kind() != reflect.Ptr {
+		msg = msg.Elem()
+	}
+	th.fn.Call([]reflect.Value{reflect.ValueOf(packet), reflect.ValueOf(&pw).Elem(), msg})
+}
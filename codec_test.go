@@ -0,0 +1,149 @@
+package hacket
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type greeting struct {
+	Name  string
+	Count int
+}
+
+// counter is a ProtoMessage encoded as a big endian uint32
+type counter struct {
+	value uint32
+}
+
+func (c *counter) Marshal() ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, c.value)
+	return b, nil
+}
+
+func (c *counter) Unmarshal(data []byte) error {
+	if len(data) != 4 {
+		return ErrShortPacket
+	}
+	c.value = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec, CBORCodec, MsgpackCodec} {
+		msg, err := EncodePacketMessage(codec, 7, greeting{Name: "hacket", Count: 2})
+		if err != nil {
+			t.Fatal(codec.Name(), "error encoding:", err)
+		}
+		if PacketType(msg[0]) != 7 {
+			t.Error(codec.Name(), "expected PacketType 7 got", msg[0])
+		}
+		var got greeting
+		if err := codec.Unmarshal(msg[1:], &got); err != nil || got != (greeting{Name: "hacket", Count: 2}) {
+			t.Errorf("%s expected round trip got %+v %v", codec.Name(), got, err)
+		}
+	}
+
+	msg, err := EncodePacketMessage(ProtoCodec, 7, &counter{value: 42})
+	if err != nil {
+		t.Fatal("Error encoding proto:", err)
+	}
+	var got counter
+	if err := ProtoCodec.Unmarshal(msg[1:], &got); err != nil || got.value != 42 {
+		t.Errorf("Expected 42 got %d %v", got.value, err)
+	}
+	if _, err := ProtoCodec.Marshal(greeting{}); err != ErrNotProtoMessage {
+		t.Error("Expected ErrNotProtoMessage got", err)
+	}
+}
+
+func TestTypedPacketHandler(t *testing.T) {
+	mux := NewPacketMux()
+	var greetings []greeting
+	err := mux.TypedPacketHandler(1, JSONCodec, func(packet Packet, pw PacketWriter, msg *greeting) {
+		greetings = append(greetings, *msg)
+		WriteMessage(packet.Context(), pw, JSONCodec, 1, msg, packet.FromAddr())
+	})
+	if err != nil {
+		t.Fatal("Error registering typed handler:", err)
+	}
+	var counters []uint32
+	err = mux.TypedPacketHandler(2, ProtoCodec, func(packet Packet, pw PacketWriter, msg counter) {
+		counters = append(counters, msg.value)
+	})
+	if err != nil {
+		t.Fatal("Error registering typed handler:", err)
+	}
+	var decodeErrs []error
+	mux.SetDecodeErrorHandler(func(packet Packet, pw PacketWriter, err error) {
+		decodeErrs = append(decodeErrs, err)
+	})
+
+	pw := &recordingPacketWriter{}
+	msg, _ := EncodePacketMessage(JSONCodec, 1, greeting{Name: "a", Count: 1})
+	mux.HandlePacket(NewPacket(msg, nil, time.Now()), pw)
+	msg, _ = EncodePacketMessage(ProtoCodec, 2, &counter{value: 3})
+	mux.HandlePacket(NewPacket(msg, nil, time.Now()), pw)
+	mux.HandlePacket(newTestPacket(1, "{not json"), pw)
+
+	if len(greetings) != 1 || greetings[0].Name != "a" {
+		t.Error("Expected one decoded greeting got", greetings)
+	}
+	if len(counters) != 1 || counters[0] != 3 {
+		t.Error("Expected one decoded counter got", counters)
+	}
+	if len(decodeErrs) != 1 {
+		t.Error("Expected one decode error got", decodeErrs)
+	}
+	if len(pw.msgs) != 1 || string(pw.msgs[0][1:]) != `{"Name":"a","Count":1}` {
+		t.Errorf("Expected encoded reply got %q", pw.msgs)
+	}
+}
+
+func TestTypedHandlerValidation(t *testing.T) {
+	invalid := []interface{}{
+		func(packet Packet, pw PacketWriter) {},
+		func(packet Packet, msg *greeting) {},
+		func(packet Packet, pw PacketWriter, msg *greeting) error { return nil },
+		"not a func",
+	}
+	for _, fn := range invalid {
+		if _, err := NewTypedHandler(JSONCodec, fn, nil); err != ErrInvalidTypedHandler {
+			t.Errorf("Expected ErrInvalidTypedHandler for %T got %v", fn, err)
+		}
+	}
+	if _, err := NewTypedHandler(nil, func(Packet, PacketWriter, *greeting) {}, nil); err != ErrNilCodec {
+		t.Error("Expected ErrNilCodec got", err)
+	}
+	handler, err := NewTypedHandler(JSONCodec, func(Packet, PacketWriter, *greeting) {}, nil)
+	if err != nil || handler == nil {
+		t.Fatal("Expected a handler got", err)
+	}
+}
+
+func TestTypedHandlerDecodeErrorDropped(t *testing.T) {
+	dropped := make(chan DropReason, 1)
+	server, client, err := New("udp", "127.0.0.1:0", WithDropHandler(func(packet Packet, reason DropReason) {
+		dropped <- reason
+	}))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.TypedPacketHandler(1, JSONCodec, func(packet Packet, pw PacketWriter, msg *greeting) {
+		t.Error("Expected handler not to be called")
+	})
+	go server.Serve(mux)
+	client.WriteTo(PacketMessage{1, '{'}, server.Addr())
+	select {
+	case reason := <-dropped:
+		if reason != DropReasonMalformed {
+			t.Error("Expected malformed drop got", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for drop")
+	}
+}
@@ -0,0 +1,395 @@
+package hacket
+
+import (
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a packet that arrives when the queue
+// it would be added to is full
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock stops reading from the connection until there is room in
+	// the queue, applying backpressure to the socket's receive buffer
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the packet that just arrived
+	OverflowDropNewest
+	// OverflowDropOldest discards the packet that has been queued the longest
+	// to make room for the packet that just arrived
+	OverflowDropOldest
+	// OverflowShed discards packets of the PacketTypes marked as sheddable. A
+	// sheddable packet that arrives is discarded, otherwise the oldest queued
+	// sheddable packet makes room for it. When no queued packet is sheddable
+	// reading stops until there is room, as with OverflowBlock
+	OverflowShed
+)
+
+// dispatcher hands packets read by Serve to the workers that handle them
+type dispatcher interface {
+	// dispatch queues d to be handled. It may block until there is room
+	dispatch(d delivery)
+	// close stops accepting deliveries. Workers exit once queued deliveries are handled
+	close()
+}
+
+// poolDispatcher hands each packet to the next free worker. dispatch blocks
+// while every worker is busy
+type poolDispatcher struct {
+	deliveries chan delivery
+}
+
+// newPoolDispatcher starts workers goroutines that call handle for each delivery
+func newPoolDispatcher(workers uint32, wg *sync.WaitGroup, handle func(d delivery)) *poolDispatcher {
+	pd := &poolDispatcher{deliveries: make(chan delivery)}
+	for i := uint32(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range pd.deliveries {
+				handle(d)
+			}
+		}()
+	}
+	return pd
+}
+
+func (pd *poolDispatcher) dispatch(d delivery) {
+	pd.deliveries <- d
+}
+
+func (pd *poolDispatcher) close() {
+	close(pd.deliveries)
+}
+
+// peerQueue holds the packets from a single peer that are waiting to be handled
+type peerQueue struct {
+	key   string
+	items []delivery
+}
+
+// orderedDispatcher queues packets per peer so that the packets from a peer
+// are handled one at a time in the order they arrived, while packets from
+// different peers are handled in parallel. A peer waiting on a worker is in
+// the run queue at most once and a peer being handled is not in the run queue,
+// so no two workers handle packets from the same peer at the same time.
+type orderedDispatcher struct {
+	queueSize int
+	policy    OverflowPolicy
+	handle    func(d delivery)
+	drops     *dropCounter
+
+	mu     sync.Mutex
+	work   *sync.Cond // signalled when the run queue grows or the dispatcher closes
+	space  *sync.Cond // signalled when a peer queue shrinks
+	peers  map[string]*peerQueue
+	runq   []*peerQueue
+	closed bool
+}
+
+// newOrderedDispatcher starts workers goroutines that handle packets in per peer order
+func newOrderedDispatcher(workers uint32, queueSize int, policy OverflowPolicy, drops *dropCounter, wg *sync.WaitGroup, handle func(d delivery)) *orderedDispatcher {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	od := &orderedDispatcher{
+		queueSize: queueSize,
+		policy:    policy,
+		handle:    handle,
+		drops:     drops,
+		peers:     make(map[string]*peerQueue),
+	}
+	od.work = sync.NewCond(&od.mu)
+	od.space = sync.NewCond(&od.mu)
+	for i := uint32(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			od.run()
+		}()
+	}
+	return od
+}
+
+// peerKey identifies the peer a packet came from
+func peerKey(d delivery) string {
+	if addr := d.packet.FromAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func (od *orderedDispatcher) dispatch(d delivery) {
+	dropped, ok := od.enqueue(d)
+	if !ok {
+		od.drops.drop(dropped.packet, DropReasonPeerQueueFull)
+		dropped.packet.Release()
+	}
+}
+
+// enqueue adds d to its peer's queue. When the overflow policy discards a
+// packet it is returned with false so it can be reported without holding the lock
+func (od *orderedDispatcher) enqueue(d delivery) (delivery, bool) {
+	key := peerKey(d)
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	q, ok := od.peers[key]
+	if !ok {
+		q = &peerQueue{key: key}
+		od.peers[key] = q
+		od.runq = append(od.runq, q)
+		od.work.Signal()
+	}
+	for len(q.items) >= od.queueSize {
+		switch od.policy {
+		case OverflowDropNewest:
+			return d, false
+		case OverflowDropOldest:
+			oldest := q.items[0]
+			q.items[0] = delivery{}
+			q.items = append(q.items[1:], d)
+			return oldest, false
+		default:
+			od.space.Wait()
+		}
+	}
+	q.items = append(q.items, d)
+	return delivery{}, true
+}
+
+// run handles packets from the run queue until the dispatcher is closed and drained
+func (od *orderedDispatcher) run() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	for {
+		for len(od.runq) == 0 && !od.closed {
+			od.work.Wait()
+		}
+		if len(od.runq) == 0 {
+			return
+		}
+		q := od.runq[0]
+		od.runq[0] = nil
+		od.runq = od.runq[1:]
+		if len(q.items) == 0 {
+			delete(od.peers, q.key)
+			continue
+		}
+		d := q.items[0]
+		q.items[0] = delivery{}
+		q.items = q.items[1:]
+		od.space.Broadcast()
+
+		od.mu.Unlock()
+		od.handle(d)
+		od.mu.Lock()
+
+		if len(q.items) > 0 {
+			// go to the back of the run queue so busy peers do not starve others
+			od.runq = append(od.runq, q)
+			od.work.Signal()
+		} else {
+			delete(od.peers, q.key)
+		}
+	}
+}
+
+func (od *orderedDispatcher) close() {
+	od.mu.Lock()
+	od.closed = true
+	od.work.Broadcast()
+	od.mu.Unlock()
+}
+
+// Priority orders the handling of queued packets by PacketType
+type Priority uint8
+
+const (
+	// PriorityLow packets are handled when no other packets are waiting
+	PriorityLow Priority = iota
+	// PriorityNormal is the priority of PacketTypes without an assigned priority
+	PriorityNormal
+	// PriorityHigh packets are handled before all other waiting packets and
+	// are the only packets handled by reserved workers
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+// queueDispatcher queues packets by the priority of their PacketType. Workers
+// always take the oldest packet of the highest priority that is waiting.
+// Reserved workers only handle PriorityHigh packets, so latency sensitive
+// PacketTypes are handled even while every other worker is busy.
+type queueDispatcher struct {
+	queueSize  int
+	priorities map[PacketType]Priority
+	policy     OverflowPolicy
+	shed       map[PacketType]bool
+	handle     func(d delivery)
+	drops      *dropCounter
+
+	mu       sync.Mutex
+	work     *sync.Cond // signalled when a packet is queued for any worker
+	reserved *sync.Cond // signalled when a PriorityHigh packet is queued
+	space    *sync.Cond // signalled when a queue shrinks
+	queues   [numPriorities][]delivery
+	closed   bool
+}
+
+// newQueueDispatcher starts workers general workers and reserved PriorityHigh workers
+func newQueueDispatcher(workers uint32, reserved uint32, queueSize int, priorities map[PacketType]Priority, policy OverflowPolicy, shed map[PacketType]bool, drops *dropCounter, wg *sync.WaitGroup, handle func(d delivery)) *queueDispatcher {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	qd := &queueDispatcher{
+		queueSize:  queueSize,
+		priorities: priorities,
+		policy:     policy,
+		shed:       shed,
+		handle:     handle,
+		drops:      drops,
+	}
+	qd.work = sync.NewCond(&qd.mu)
+	qd.reserved = sync.NewCond(&qd.mu)
+	qd.space = sync.NewCond(&qd.mu)
+	start := func(minPriority Priority, cond *sync.Cond) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qd.run(minPriority, cond)
+		}()
+	}
+	for i := uint32(0); i < workers; i++ {
+		start(PriorityLow, qd.work)
+	}
+	for i := uint32(0); i < reserved; i++ {
+		start(PriorityHigh, qd.reserved)
+	}
+	return qd
+}
+
+// packetType returns the PacketType of the delivery's message
+func packetType(d delivery) (PacketType, bool) {
+	h, err := decodeHeader(d.packet.Msg())
+	return h.pktType, err == nil
+}
+
+// priority returns the priority of the delivery's PacketType
+func (qd *queueDispatcher) priority(d delivery) Priority {
+	if pktType, ok := packetType(d); ok {
+		if p, ok := qd.priorities[pktType]; ok {
+			return p
+		}
+	}
+	return PriorityNormal
+}
+
+// sheddable reports whether the delivery's PacketType may be shed
+func (qd *queueDispatcher) sheddable(d delivery) bool {
+	pktType, ok := packetType(d)
+	return ok && qd.shed[pktType]
+}
+
+func (qd *queueDispatcher) dispatch(d delivery) {
+	dropped, ok := qd.enqueue(d)
+	if !ok {
+		qd.drops.drop(dropped.packet, DropReasonOverload)
+		dropped.packet.Release()
+	}
+}
+
+// enqueue adds d to the queue for its priority. When the overload policy
+// discards a packet it is returned with false so it can be reported without
+// holding the lock
+func (qd *queueDispatcher) enqueue(d delivery) (delivery, bool) {
+	p := qd.priority(d)
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+	var dropped delivery
+	ok := true
+	for ok && len(qd.queues[p]) >= qd.queueSize {
+		switch qd.policy {
+		case OverflowDropNewest:
+			return d, false
+		case OverflowDropOldest:
+			dropped, ok = qd.remove(p, 0), false
+		case OverflowShed:
+			if qd.sheddable(d) {
+				return d, false
+			}
+			if i := qd.oldestSheddable(p); i >= 0 {
+				dropped, ok = qd.remove(p, i), false
+				continue
+			}
+			qd.space.Wait()
+		default:
+			qd.space.Wait()
+		}
+	}
+	qd.queues[p] = append(qd.queues[p], d)
+	qd.work.Signal()
+	if p == PriorityHigh {
+		qd.reserved.Signal()
+	}
+	return dropped, ok
+}
+
+// oldestSheddable returns the index of the oldest sheddable delivery of priority p or -1
+func (qd *queueDispatcher) oldestSheddable(p Priority) int {
+	for i, d := range qd.queues[p] {
+		if qd.sheddable(d) {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the delivery at index i of the queue for priority p
+func (qd *queueDispatcher) remove(p Priority, i int) delivery {
+	q := qd.queues[p]
+	d := q[i]
+	copy(q[i:], q[i+1:])
+	q[len(q)-1] = delivery{}
+	qd.queues[p] = q[:len(q)-1]
+	return d
+}
+
+// next removes the oldest delivery of the highest waiting priority of at least minPriority
+func (qd *queueDispatcher) next(minPriority Priority) (delivery, bool) {
+	for p := numPriorities - 1; p >= int(minPriority); p-- {
+		if len(qd.queues[p]) > 0 {
+			d := qd.queues[p][0]
+			qd.queues[p][0] = delivery{}
+			qd.queues[p] = qd.queues[p][1:]
+			return d, true
+		}
+	}
+	return delivery{}, false
+}
+
+// run handles packets of at least minPriority until the dispatcher is closed and drained
+func (qd *queueDispatcher) run(minPriority Priority, cond *sync.Cond) {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+	for {
+		d, ok := qd.next(minPriority)
+		if !ok {
+			if qd.closed {
+				return
+			}
+			cond.Wait()
+			continue
+		}
+		qd.space.Broadcast()
+		qd.mu.Unlock()
+		qd.handle(d)
+		qd.mu.Lock()
+	}
+}
+
+func (qd *queueDispatcher) close() {
+	qd.mu.Lock()
+	qd.closed = true
+	qd.work.Broadcast()
+	qd.reserved.Broadcast()
+	qd.mu.Unlock()
+}
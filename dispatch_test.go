@@ -0,0 +1,273 @@
+package hacket
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDelivery creates a delivery from a peer on port carrying seq
+func testDelivery(port int, seq byte) delivery {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	return delivery{packet: NewPacket([]byte{seq}, addr, time.Now())}
+}
+
+func TestOrderedDispatcherPeerOrder(t *testing.T) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	handled := make(map[int][]byte)
+	active := make(map[int]int)
+	od := newOrderedDispatcher(4, 100, OverflowBlock, &dropCounter{}, &wg, func(d delivery) {
+		port := d.packet.FromAddr().(*net.UDPAddr).Port
+		mu.Lock()
+		active[port]++
+		if active[port] > 1 {
+			t.Errorf("Peer %d handled concurrently", port)
+		}
+		mu.Unlock()
+		time.Sleep(time.Microsecond * 100)
+		mu.Lock()
+		active[port]--
+		handled[port] = append(handled[port], d.packet.Msg()[0])
+		mu.Unlock()
+	})
+	for seq := byte(0); seq < 50; seq++ {
+		for port := 1; port <= 3; port++ {
+			od.dispatch(testDelivery(port, seq))
+		}
+	}
+	od.close()
+	wg.Wait()
+	for port := 1; port <= 3; port++ {
+		if len(handled[port]) != 50 {
+			t.Fatalf("Expected 50 packets from peer %d, handled %d", port, len(handled[port]))
+		}
+		for i, seq := range handled[port] {
+			if seq != byte(i) {
+				t.Fatalf("Peer %d handled out of order: %v", port, handled[port])
+			}
+		}
+	}
+}
+
+func TestOrderedDispatcherParallelPeers(t *testing.T) {
+	var wg sync.WaitGroup
+	blocked := make(chan struct{})
+	handled := make(chan int, 1)
+	od := newOrderedDispatcher(2, 10, OverflowBlock, &dropCounter{}, &wg, func(d delivery) {
+		port := d.packet.FromAddr().(*net.UDPAddr).Port
+		if port == 1 {
+			<-blocked
+			return
+		}
+		handled <- port
+	})
+	defer func() {
+		close(blocked)
+		od.close()
+		wg.Wait()
+	}()
+	od.dispatch(testDelivery(1, 0))
+	od.dispatch(testDelivery(1, 1))
+	od.dispatch(testDelivery(2, 0))
+	select {
+	case port := <-handled:
+		if port != 2 {
+			t.Errorf("Expected peer 2 to be handled, handled %d", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Slow peer blocked other peers")
+	}
+}
+
+func TestOrderedDispatcherOverflow(t *testing.T) {
+	testcases := []struct {
+		name   string
+		policy OverflowPolicy
+		want   []byte
+	}{
+		{name: "test-drop-newest", policy: OverflowDropNewest, want: []byte{0, 1, 2}},
+		{name: "test-drop-oldest", policy: OverflowDropOldest, want: []byte{0, 3, 4}},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var handled []byte
+			drops := &dropCounter{}
+			started := make(chan struct{})
+			release := make(chan struct{})
+			od := newOrderedDispatcher(1, 2, tt.policy, drops, &wg, func(d delivery) {
+				seq := d.packet.Msg()[0]
+				if seq == 0 {
+					close(started)
+					<-release
+				}
+				handled = append(handled, seq)
+			})
+			od.dispatch(testDelivery(1, 0))
+			<-started
+			// queue holds two packets while the first is being handled
+			for seq := byte(1); seq < 5; seq++ {
+				od.dispatch(testDelivery(1, seq))
+			}
+			close(release)
+			od.close()
+			wg.Wait()
+			if !reflect.DeepEqual(handled, tt.want) {
+				t.Errorf("Expected %v handled, handled %v", tt.want, handled)
+			}
+			if n := drops.count(DropReasonPeerQueueFull); n != 2 {
+				t.Errorf("Expected 2 drops, counted %d", n)
+			}
+		})
+	}
+}
+
+// typedDelivery creates a delivery for a packet of pktType
+func typedDelivery(pktType PacketType, seq byte) delivery {
+	return delivery{packet: NewPacket([]byte{uint8(pktType), seq}, nil, time.Now())}
+}
+
+func TestQueueDispatcherPriorityOrder(t *testing.T) {
+	var wg sync.WaitGroup
+	var handled []PacketType
+	started := make(chan struct{})
+	release := make(chan struct{})
+	priorities := map[PacketType]Priority{controlType: PriorityHigh, PacketType(3): PriorityLow}
+	qd := newQueueDispatcher(1, 0, 10, priorities, OverflowBlock, nil, &dropCounter{}, &wg, func(d delivery) {
+		if d.packet.Msg()[1] == 0 {
+			close(started)
+			<-release
+		}
+		handled = append(handled, PacketType(d.packet.Msg()[0]))
+	})
+	qd.dispatch(typedDelivery(bulkType, 0))
+	<-started
+	qd.dispatch(typedDelivery(PacketType(3), 1))
+	qd.dispatch(typedDelivery(bulkType, 1))
+	qd.dispatch(typedDelivery(controlType, 1))
+	close(release)
+	qd.close()
+	wg.Wait()
+	want := []PacketType{bulkType, controlType, bulkType, PacketType(3)}
+	if !reflect.DeepEqual(handled, want) {
+		t.Errorf("Expected %v handled, handled %v", want, handled)
+	}
+}
+
+func TestReservedConcurrencyStarvation(t *testing.T) {
+	server, client, err := New("udp", "127.0.0.1:0", WithPriority(PriorityHigh, controlType), WithReservedConcurrency(1))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	release := make(chan struct{})
+	heartbeats := make(chan struct{}, 10)
+	mux := NewPacketMux()
+	// bulk handling saturates the only general worker
+	mux.PacketHandlerFunc(bulkType, func(packet Packet, pw PacketWriter) {
+		<-release
+	})
+	mux.PacketHandlerFunc(controlType, func(packet Packet, pw PacketWriter) {
+		heartbeats <- struct{}{}
+	})
+	go server.Serve(mux)
+	defer func() {
+		close(release)
+		server.Shutdown(context.Background())
+	}()
+
+	bulk, _ := NewPacketMessageBuilder([]byte("bulk")).WithPacketType(bulkType).Build()
+	for i := 0; i < 20; i++ {
+		client.WriteTo(bulk, server.Addr())
+	}
+	heartbeat, _ := NewPacketMessageBuilder([]byte("heartbeat")).WithPacketType(controlType).Build()
+	for i := 0; i < 3; i++ {
+		client.WriteTo(heartbeat, server.Addr())
+		select {
+		case <-heartbeats:
+		case <-time.After(time.Second):
+			t.Fatal("Heartbeat starved by bulk traffic")
+		}
+	}
+}
+
+func TestQueueDispatcherOverload(t *testing.T) {
+	testcases := []struct {
+		name    string
+		policy  OverflowPolicy
+		want    []byte
+		dropped []byte
+	}{
+		{name: "test-drop-newest", policy: OverflowDropNewest, want: []byte{0, 1, 2}, dropped: []byte{3, 4, 5}},
+		{name: "test-drop-oldest", policy: OverflowDropOldest, want: []byte{0, 4, 5}, dropped: []byte{1, 2, 3}},
+		// odd sequence numbers are bulk packets that may be shed
+		{name: "test-shed", policy: OverflowShed, want: []byte{0, 2, 4}, dropped: []byte{3, 1, 5}},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var handled, dropped []byte
+			drops := &dropCounter{handler: func(packet Packet, reason DropReason) {
+				if reason != DropReasonOverload {
+					t.Error("Unexpected drop reason:", reason)
+				}
+				dropped = append(dropped, packet.Msg()[1])
+			}}
+			started := make(chan struct{})
+			release := make(chan struct{})
+			shed := map[PacketType]bool{bulkType: true}
+			qd := newQueueDispatcher(1, 0, 2, nil, tt.policy, shed, drops, &wg, func(d delivery) {
+				seq := d.packet.Msg()[1]
+				if seq == 0 {
+					close(started)
+					<-release
+				}
+				handled = append(handled, seq)
+			})
+			qd.dispatch(typedDelivery(controlType, 0))
+			<-started
+			for seq := byte(1); seq < 6; seq++ {
+				pktType := controlType
+				if seq%2 == 1 {
+					pktType = bulkType
+				}
+				qd.dispatch(typedDelivery(pktType, seq))
+			}
+			close(release)
+			qd.close()
+			wg.Wait()
+			if !reflect.DeepEqual(handled, tt.want) {
+				t.Errorf("Expected %v handled, handled %v", tt.want, handled)
+			}
+			if !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("Expected %v dropped, dropped %v", tt.dropped, dropped)
+			}
+			if n := drops.count(DropReasonOverload); n != uint64(len(tt.dropped)) {
+				t.Errorf("Expected %d drops counted, counted %d", len(tt.dropped), n)
+			}
+		})
+	}
+}
+
+func TestOrderedDispatchConflictingOptions(t *testing.T) {
+	testcases := []struct {
+		name    string
+		options []Options
+		err     error
+	}{
+		{name: "overload", options: []Options{WithOrderedDispatch(8, OverflowBlock), WithOverloadPolicy(OverflowDropNewest)}, err: ErrConflictingOptions},
+		{name: "priority", options: []Options{WithPriority(PriorityHigh, 1), WithOrderedDispatch(8, OverflowBlock)}, err: ErrConflictingOptions},
+		{name: "reserved", options: []Options{WithOrderedDispatch(8, OverflowBlock), WithReservedConcurrency(1)}, err: ErrConflictingOptions},
+		{name: "shed", options: []Options{WithOrderedDispatch(8, OverflowShed)}, err: ErrUnsupportedPeerQueuePolicy},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := New("udp", "127.0.0.1:0", tt.options...); err != tt.err {
+				t.Errorf("Expected %v, received %v", tt.err, err)
+			}
+		})
+	}
+}
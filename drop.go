@@ -0,0 +1,84 @@
+package hacket
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DropReason describes why a received packet was discarded before it was handled
+type DropReason uint8
+
+const (
+	// DropReasonOverload the server's queue was full
+	DropReasonOverload DropReason = iota
+	// DropReasonPeerQueueFull the peer's queue was full when using ordered dispatch
+	DropReasonPeerQueueFull
+	// DropReasonMalformed the packet could not be decoded
+	DropReasonMalformed
+	// DropReasonDuplicate the packet was a retransmission of a reliable message already received
+	DropReasonDuplicate
+	// DropReasonChecksum the packet's checksum did not match or a required checksum was missing
+	DropReasonChecksum
+	// DropReasonUnauthenticated the packet could not be opened with a key from the Keyring
+	DropReasonUnauthenticated
+	// DropReasonReplay the sealed packet was already received
+	DropReasonReplay
+	// DropReasonStale the sealed packet is older than the replay window
+	DropReasonStale
+
+	numDropReasons = int(DropReasonStale) + 1
+)
+
+// String returns a readable name for the DropReason
+func (r DropReason) String() string {
+	switch r {
+	case DropReasonOverload:
+		return "overload"
+	case DropReasonPeerQueueFull:
+		return "peer_queue_full"
+	case DropReasonMalformed:
+		return "malformed"
+	case DropReasonDuplicate:
+		return "duplicate"
+	case DropReasonChecksum:
+		return "checksum"
+	case DropReasonUnauthenticated:
+		return "unauthenticated"
+	case DropReasonReplay:
+		return "replay"
+	case DropReasonStale:
+		return "stale"
+	default:
+		return fmt.Sprintf("DropReason(%d)", uint8(r))
+	}
+}
+
+// dropCounter counts dropped packets by DropReason and reports them to the
+// configured drop handler and observer
+type dropCounter struct {
+	counts   [numDropReasons]uint64
+	handler  func(packet Packet, reason DropReason)
+	observer Observer
+}
+
+// drop counts packet as dropped for reason and reports it. The caller is
+// responsible for releasing the packet
+func (dc *dropCounter) drop(packet Packet, reason DropReason) {
+	if int(reason) < numDropReasons {
+		atomic.AddUint64(&dc.counts[reason], 1)
+	}
+	if dc.handler != nil {
+		dc.handler(packet, reason)
+	}
+	if dc.observer != nil {
+		dc.observer.OnPacketDropped(packet, reason)
+	}
+}
+
+// count returns the number of packets dropped for reason
+func (dc *dropCounter) count(reason DropReason) uint64 {
+	if int(reason) >= numDropReasons {
+		return 0
+	}
+	return atomic.LoadUint64(&dc.counts[reason])
+}
@@ -0,0 +1,764 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/handshake"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/deadline"
+)
+
+const (
+	// maxDTLSPeers bounds the number of DTLS sessions a connection keeps
+	maxDTLSPeers = 4096
+	// maxDTLSPendingHandshakes bounds the number of handshakes accepted from
+	// peers that are in progress. The sources of these handshakes have not been
+	// verified yet, so the limit is far smaller than maxDTLSPeers
+	maxDTLSPendingHandshakes = 256
+	// maxDTLSPendingPerSource bounds the number of handshakes accepted from a
+	// single host that are in progress, so a few sources cannot take up every
+	// pending handshake
+	maxDTLSPendingPerSource = 8
+	// dtlsPeerQueueSize is the number of undelivered datagrams buffered for a
+	// peer. DTLS tolerates loss so further datagrams are discarded
+	dtlsPeerQueueSize = 64
+)
+
+// DTLSConfig configures the DTLS 1.2 transport, see WithDTLS. Every endpoint
+// both accepts sessions from peers writing to it and establishes sessions with
+// peers it writes to, so an endpoint that accepts sessions needs Certificates
+// or a PSK
+type DTLSConfig struct {
+	// Certificates are presented to peers. The first certificate is used unless
+	// the peer requests otherwise
+	Certificates []tls.Certificate
+	// RootCAs verifies the certificates of peers this endpoint establishes
+	// sessions with. The system roots are used when nil
+	RootCAs *x509.CertPool
+	// ClientCAs verifies the certificates of peers establishing sessions with
+	// this endpoint when RequireClientCert is set
+	ClientCAs *x509.CertPool
+	// RequireClientCert requires peers establishing sessions with this endpoint
+	// to present a certificate signed by ClientCAs
+	RequireClientCert bool
+	// ServerName is the name verified against the certificates of peers. The
+	// host of the peer's address is used when empty
+	ServerName string
+	// InsecureSkipVerify accepts any certificate presented by a peer. It should
+	// only be used for testing
+	InsecureSkipVerify bool
+	// PSK returns the pre-shared key for the identity hint sent by the peer.
+	// Setting PSK enables the PSK cipher suites
+	PSK func(hint []byte) ([]byte, error)
+	// PSKIdentityHint is sent to peers to select the pre-shared key
+	PSKIdentityHint []byte
+	// HandshakeTimeout is how long a handshake may take before it is abandoned.
+	// Five seconds is used when zero
+	HandshakeTimeout time.Duration
+	// IdleTimeout is how long a session may go without reading or writing a
+	// datagram before it is closed. Five minutes is used when zero
+	IdleTimeout time.Duration
+}
+
+// dtlsConfig converts c into the configuration used for handshakes
+func (c DTLSConfig) dtlsConfig() *dtls.Config {
+	config := &dtls.Config{
+		Certificates:         c.Certificates,
+		RootCAs:              c.RootCAs,
+		ClientCAs:            c.ClientCAs,
+		ServerName:           c.ServerName,
+		InsecureSkipVerify:   c.InsecureSkipVerify,
+		PSKIdentityHint:      c.PSKIdentityHint,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	if c.RequireClientCert {
+		config.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
+	if c.PSK != nil {
+		config.PSK = dtls.PSKCallback(c.PSK)
+		config.CipherSuites = []dtls.CipherSuiteID{
+			dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+			dtls.TLS_PSK_WITH_AES_128_CCM,
+			dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		}
+		if len(c.Certificates) > 0 {
+			config.CipherSuites = append(config.CipherSuites,
+				dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			)
+		}
+	}
+	return config
+}
+
+// dtlsTransport listens on a udp socket and secures it with DTLS. It is
+// registered for the dtls, dtls4 and dtls6 networks
+type dtlsTransport struct{}
+
+// Listen statifies the Transport interface. The DTLS transport must be
+// configured with WithDTLS so it can only be used through New
+func (dtlsTransport) Listen(network string, address string) (net.PacketConn, error) {
+	return nil, ErrDTLSConfigRequired
+}
+
+// listenWithOptions statifies the optionsTransport interface
+func (dtlsTransport) listenWithOptions(network string, address string, options *packetOptions) (net.PacketConn, error) {
+	if options.DTLS == nil {
+		return nil, ErrDTLSConfigRequired
+	}
+	udpNetwork := "udp" + strings.TrimPrefix(network, "dtls")
+	conn, err := listenUDP(udpNetwork, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewDTLSPacketConn(conn, *options.DTLS), nil
+}
+
+// dtlsDatagram is a decrypted datagram and the peer that sent it
+type dtlsDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// dtlsPacketConn secures a net.PacketConn with a DTLS session for each peer
+type dtlsPacketConn struct {
+	conn        net.PacketConn
+	config      DTLSConfig
+	server      *dtls.Config
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	datagrams     chan dtlsDatagram
+	readDeadline  *deadline.Deadline
+	writeDeadline *deadline.Deadline
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	mu    sync.Mutex
+	peers map[string]*dtlsPeer
+	// pending is the number of handshakes accepted from peers in progress and
+	// pendingBySource the number in progress for each host
+	pending         int
+	pendingBySource map[string]int
+}
+
+// NewDTLSPacketConn secures conn with DTLS 1.2. A session is established with
+// a peer the first time a datagram is written to it, or accepted when the peer
+// establishes one, and datagrams are encrypted for the session. Only a
+// ClientHello starts a handshake, and the peer must echo the cookie of a
+// HelloVerifyRequest before any key exchange is performed. A ClientHello with
+// a new random from a peer with an established session is taken as the peer
+// restarting, and the new session replaces the old one once its handshake
+// completes. When both peers write to each other for the first time at once
+// the peer that sent the lower ClientHello random abandons its handshake and
+// accepts the other. Sessions idle for longer than the idle timeout are
+// closed. The returned connection can be passed to NewFromConn and closes
+// conn when it is closed
+func NewDTLSPacketConn(conn net.PacketConn, config DTLSConfig) net.PacketConn {
+	c := &dtlsPacketConn{
+		conn:          conn,
+		config:        config,
+		server:        config.dtlsConfig(),
+		timeout:       config.HandshakeTimeout,
+		idleTimeout:   config.IdleTimeout,
+		datagrams:     make(chan dtlsDatagram, dtlsPeerQueueSize),
+		readDeadline:  deadline.New(),
+		writeDeadline: deadline.New(),
+		closed:        make(chan struct{}),
+		peers:         make(map[string]*dtlsPeer),
+
+		pendingBySource: make(map[string]int),
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	if c.idleTimeout <= 0 {
+		c.idleTimeout = 5 * time.Minute
+	}
+	go c.readLoop()
+	go c.expireLoop()
+	return c
+}
+
+// readLoop reads datagrams from the connection and passes them to the DTLS
+// session of their peer, accepting a new session for unknown peers
+func (c *dtlsPacketConn) readLoop() {
+	buf := make([]byte, udpPacketBufSize)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if p, ok := c.accept(addr, buf[:n]); ok {
+			p.deliver(buf[:n])
+		}
+	}
+}
+
+// expireLoop closes sessions that have been idle for longer than the idle
+// timeout until the connection is closed
+func (c *dtlsPacketConn) expireLoop() {
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.expire(now)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// expire closes established sessions idle since before now less the idle timeout
+func (c *dtlsPacketConn) expire(now time.Time) {
+	c.mu.Lock()
+	var idle []*dtlsPeer
+	for _, p := range c.peers {
+		if p.established() && now.Sub(p.active()) > c.idleTimeout {
+			idle = append(idle, p)
+		}
+	}
+	c.mu.Unlock()
+	for _, p := range idle {
+		// a close_notify alert tells the peer to forget the session too
+		p.conn.Close()
+	}
+}
+
+// accept returns the session b was received for. A handshake is only started
+// for an unknown peer when b is a ClientHello, so datagrams from spoofed
+// sources are discarded without allocating a session. A ClientHello from a
+// peer this connection is establishing a session with resolves which of them
+// accepts the other's handshake, and a ClientHello with a new random from a
+// peer with an established session starts the handshake of the restarted peer
+func (c *dtlsPacketConn) accept(addr net.Addr, b []byte) (*dtlsPeer, bool) {
+	random, hello := clientHelloRandom(b)
+	c.mu.Lock()
+	p, ok := c.peers[addr.String()]
+	if ok && p.established() {
+		if hello && !bytes.Equal(p.peerHello, random) {
+			return c.restart(p, random)
+		}
+		restart := p.restart
+		c.mu.Unlock()
+		if restart != nil && !hello {
+			if epoch, ok := recordEpoch(b); ok && epoch == 0 {
+				return restart, true
+			}
+			// records of later epochs finish either handshake, the session
+			// that cannot decrypt them discards them
+			restart.deliver(b)
+		}
+		return p, true
+	}
+	if ok && (!hello || !p.client) {
+		c.mu.Unlock()
+		return p, true
+	}
+	if ok && p.hello != nil && bytes.Compare(p.hello, random) > 0 {
+		// both peers are establishing a session with each other. The peer that
+		// sent the lower random yields, which is the other peer
+		c.mu.Unlock()
+		return nil, false
+	}
+	if (!ok && !hello) || !c.canAccept(addr) {
+		c.mu.Unlock()
+		return nil, false
+	}
+	if ok {
+		// this peer yields, its handshake is aborted and the peer's accepted
+		p.yielded = true
+		delete(c.peers, addr.String())
+	}
+	accepted, created := c.newPeer(addr, false, random)
+	c.mu.Unlock()
+	if ok {
+		p.Close()
+	}
+	return accepted, created
+}
+
+// restart accepts the handshake of a peer that restarted and sent a
+// ClientHello with random while p is established. The old session is kept
+// until the new handshake completes, so a ClientHello from a spoofed source
+// cannot close it. It must be called with mu held and unlocks it
+func (c *dtlsPacketConn) restart(p *dtlsPeer, random []byte) (*dtlsPeer, bool) {
+	abandoned := p.restart
+	if abandoned != nil && bytes.Equal(abandoned.peerHello, random) {
+		c.mu.Unlock()
+		return abandoned, true
+	}
+	if !c.canAccept(p.addr) {
+		c.mu.Unlock()
+		return nil, false
+	}
+	r, ok := c.startPeer(p.addr, false, random)
+	if ok {
+		r.replaces = p
+		p.restart = r
+	}
+	c.mu.Unlock()
+	if ok && abandoned != nil {
+		// the peer restarted again, only its latest handshake can complete
+		abandoned.Close()
+	}
+	return r, ok
+}
+
+// canAccept reports whether a handshake from addr can be accepted without
+// exceeding the pending handshake limits. It must be called with mu held
+func (c *dtlsPacketConn) canAccept(addr net.Addr) bool {
+	return c.pending < maxDTLSPendingHandshakes && c.pendingBySource[sourceKey(addr)] < maxDTLSPendingPerSource
+}
+
+// sourceKey returns the host of addr, which the pending handshakes of a
+// source are counted by
+func sourceKey(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// dial returns the session with addr, starting a handshake when there is none
+func (c *dtlsPacketConn) dial(addr net.Addr) (*dtlsPeer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.peers[addr.String()]; ok {
+		return p, true
+	}
+	return c.newPeer(addr, true, nil)
+}
+
+// newPeer starts a handshake with addr and keeps the session. peerHello is the
+// random of the ClientHello the peer started the handshake with. It must be
+// called with mu held
+func (c *dtlsPacketConn) newPeer(addr net.Addr, client bool, peerHello []byte) (*dtlsPeer, bool) {
+	if len(c.peers) >= maxDTLSPeers {
+		return nil, false
+	}
+	p, ok := c.startPeer(addr, client, peerHello)
+	if ok {
+		c.peers[addr.String()] = p
+	}
+	return p, ok
+}
+
+// startPeer starts a handshake with addr. It must be called with mu held
+func (c *dtlsPacketConn) startPeer(addr net.Addr, client bool, peerHello []byte) (*dtlsPeer, bool) {
+	select {
+	case <-c.closed:
+		return nil, false
+	default:
+	}
+	p := &dtlsPeer{
+		parent:       c,
+		addr:         addr,
+		client:       client,
+		in:           make(chan []byte, dtlsPeerQueueSize),
+		closed:       make(chan struct{}),
+		readDeadline: deadline.New(),
+		ready:        make(chan struct{}),
+	}
+	if peerHello != nil {
+		p.peerHello = append([]byte(nil), peerHello...)
+	}
+	p.touch()
+	if !client {
+		c.pending++
+		c.pendingBySource[sourceKey(addr)]++
+	}
+	go c.handshake(p)
+	return p, true
+}
+
+// remove forgets the session with p
+func (c *dtlsPacketConn) remove(p *dtlsPeer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peers[p.addr.String()] == p {
+		delete(c.peers, p.addr.String())
+	}
+}
+
+// clientConfig returns the configuration used to establish a session with addr
+func (c *dtlsPacketConn) clientConfig(addr net.Addr) *dtls.Config {
+	config := c.config.dtlsConfig()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
+
+// handshake establishes the session with p and delivers its datagrams until
+// the session is closed
+func (c *dtlsPacketConn) handshake(p *dtlsPeer) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	conn, err := c.establish(ctx, p)
+	cancel()
+	c.mu.Lock()
+	p.conn, p.err = conn, err
+	if !p.client {
+		c.pending--
+		source := sourceKey(p.addr)
+		if c.pendingBySource[source]--; c.pendingBySource[source] == 0 {
+			delete(c.pendingBySource, source)
+		}
+	}
+	replaced := c.replace(p)
+	c.mu.Unlock()
+	close(p.ready)
+	if replaced != nil {
+		replaced.Close()
+	}
+	if p.err != nil {
+		p.Close()
+		return
+	}
+	for {
+		buf := make([]byte, udpPacketBufSize)
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			p.conn.Close()
+			return
+		}
+		// only datagrams the session authenticated keep it active
+		p.touch()
+		select {
+		case c.datagrams <- dtlsDatagram{b: buf[:n], addr: p.addr}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// replace makes p the session with its peer when p is the handshake of a
+// peer that restarted and it succeeded. The session p replaces is returned so
+// it can be closed. It must be called with mu held
+func (c *dtlsPacketConn) replace(p *dtlsPeer) *dtlsPeer {
+	old := p.replaces
+	if old == nil || old.restart != p {
+		return nil
+	}
+	old.restart = nil
+	if p.err != nil {
+		return nil
+	}
+	key := p.addr.String()
+	if current, ok := c.peers[key]; ok && current != old {
+		return nil
+	}
+	c.peers[key] = p
+	return old
+}
+
+// establish performs the handshake with p in its role
+func (c *dtlsPacketConn) establish(ctx context.Context, p *dtlsPeer) (*dtls.Conn, error) {
+	if p.client {
+		return dtls.ClientWithContext(ctx, p, c.clientConfig(p.addr))
+	}
+	return dtls.ServerWithContext(ctx, p, c.server)
+}
+
+// clientHelloRandom returns the random of the ClientHello b starts with. It
+// returns false when b does not start with a ClientHello
+func clientHelloRandom(b []byte) ([]byte, bool) {
+	const randomOffset = recordlayer.HeaderSize + handshake.HeaderLength + 2
+	if len(b) < randomOffset+handshake.RandomLength {
+		return nil, false
+	}
+	var record recordlayer.Header
+	if err := record.Unmarshal(b); err != nil || record.ContentType != protocol.ContentTypeHandshake || record.Epoch != 0 {
+		return nil, false
+	}
+	var header handshake.Header
+	if err := header.Unmarshal(b[recordlayer.HeaderSize:]); err != nil || header.Type != handshake.TypeClientHello || header.FragmentOffset != 0 {
+		return nil, false
+	}
+	return b[randomOffset : randomOffset+handshake.RandomLength], true
+}
+
+// recordEpoch returns the epoch of the record b starts with
+func recordEpoch(b []byte) (uint16, bool) {
+	var record recordlayer.Header
+	if err := record.Unmarshal(b); err != nil {
+		return 0, false
+	}
+	return record.Epoch, true
+}
+
+// ReadFrom statifies the net.PacketConn interface
+func (c *dtlsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.datagrams:
+		return copy(b, d.b), d.addr, nil
+	case <-c.closed:
+		return 0, nil, ErrDTLSConnClosed
+	case <-c.readDeadline.Done():
+		return 0, nil, dtlsTimeoutError{}
+	}
+}
+
+// WriteTo statifies the net.PacketConn interface. The first write to a peer
+// waits for the handshake to complete
+func (c *dtlsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var p *dtlsPeer
+	for {
+		var ok bool
+		p, ok = c.dial(addr)
+		if !ok {
+			select {
+			case <-c.closed:
+				return 0, ErrDTLSConnClosed
+			default:
+				return 0, ErrTooManyDTLSPeers
+			}
+		}
+		select {
+		case <-p.ready:
+		case <-c.closed:
+			return 0, ErrDTLSConnClosed
+		case <-c.writeDeadline.Done():
+			return 0, dtlsTimeoutError{}
+		}
+		c.mu.Lock()
+		yielded := p.yielded
+		c.mu.Unlock()
+		if !yielded {
+			break
+		}
+		// the peer's handshake replaced this one, wait for it instead
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.touch()
+	if t, ok := c.writeDeadline.Deadline(); ok {
+		p.conn.SetWriteDeadline(t)
+	} else {
+		p.conn.SetWriteDeadline(time.Time{})
+	}
+	return p.conn.Write(b)
+}
+
+// Close statifies the net.PacketConn interface. Established sessions are
+// closed with a close_notify alert before the connection is closed
+func (c *dtlsPacketConn) Close() error {
+	err := ErrDTLSConnClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		peers := make([]*dtlsPeer, 0, len(c.peers))
+		for _, p := range c.peers {
+			peers = append(peers, p)
+			if p.restart != nil {
+				peers = append(peers, p.restart)
+			}
+		}
+		c.mu.Unlock()
+		for _, p := range peers {
+			select {
+			case <-p.ready:
+				if p.conn != nil {
+					p.conn.Close()
+				}
+			default:
+				// abort the handshake
+				p.Close()
+			}
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// LocalAddr statifies the net.PacketConn interface
+func (c *dtlsPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline statifies the net.PacketConn interface
+func (c *dtlsPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+// SetReadDeadline statifies the net.PacketConn interface
+func (c *dtlsPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline statifies the net.PacketConn interface
+func (c *dtlsPacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+// SetReadBuffer sets the receive buffer size of the underlying connection
+func (c *dtlsPacketConn) SetReadBuffer(bytes int) error {
+	if rbs, ok := c.conn.(readBufferSetter); ok {
+		return rbs.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+// SetWriteBuffer sets the send buffer size of the underlying connection
+func (c *dtlsPacketConn) SetWriteBuffer(bytes int) error {
+	if wbs, ok := c.conn.(writeBufferSetter); ok {
+		return wbs.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// dtlsPeer is the net.Conn a DTLS session with a single peer is established
+// over. It reads the datagrams received from the peer and writes to the peer
+// with the shared connection
+type dtlsPeer struct {
+	parent       *dtlsPacketConn
+	addr         net.Addr
+	client       bool
+	in           chan []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline *deadline.Deadline
+	// lastActive is the time in nanoseconds a datagram was last exchanged
+	lastActive int64
+
+	// peerHello is the random of the ClientHello the peer started the
+	// handshake with, nil when this connection started it
+	peerHello []byte
+
+	// hello is the random of the ClientHello sent to the peer and yielded is
+	// set when the peer's handshake replaced this one. restart is the
+	// handshake of the peer after it restarted and replaces the session it
+	// restarted. They are guarded by the mutex of the parent
+	hello    []byte
+	yielded  bool
+	restart  *dtlsPeer
+	replaces *dtlsPeer
+
+	// conn and err are set once ready is closed
+	ready chan struct{}
+	conn  *dtls.Conn
+	err   error
+}
+
+// touch records that a datagram was exchanged with the peer
+func (p *dtlsPeer) touch() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+// active returns the time a datagram was last exchanged with the peer
+func (p *dtlsPeer) active() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActive))
+}
+
+// established reports whether the session with the peer has been established
+func (p *dtlsPeer) established() bool {
+	select {
+	case <-p.ready:
+		return p.err == nil
+	default:
+		return false
+	}
+}
+
+// deliver queues a copy of the datagram b for the session, discarding it when
+// the queue is full
+func (p *dtlsPeer) deliver(b []byte) {
+	d := make([]byte, len(b))
+	copy(d, b)
+	select {
+	case p.in <- d:
+	default:
+	}
+}
+
+// Read statifies the net.Conn interface
+func (p *dtlsPeer) Read(b []byte) (int, error) {
+	select {
+	case d := <-p.in:
+		return copy(b, d), nil
+	case <-p.closed:
+		return 0, io.EOF
+	case <-p.readDeadline.Done():
+		return 0, dtlsTimeoutError{}
+	}
+}
+
+// Write statifies the net.Conn interface. The random of the first ClientHello
+// written is kept to resolve handshakes both peers start at once
+func (p *dtlsPeer) Write(b []byte) (int, error) {
+	if p.client && !p.established() {
+		if random, ok := clientHelloRandom(b); ok {
+			p.parent.mu.Lock()
+			if p.hello == nil {
+				p.hello = append([]byte(nil), random...)
+			}
+			p.parent.mu.Unlock()
+		}
+	}
+	return p.parent.conn.WriteTo(b, p.addr)
+}
+
+// Close statifies the net.Conn interface. The peer is forgotten so the next
+// datagram exchanged with it starts a new session
+func (p *dtlsPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.parent.remove(p)
+	})
+	return nil
+}
+
+// LocalAddr statifies the net.Conn interface
+func (p *dtlsPeer) LocalAddr() net.Addr {
+	return p.parent.conn.LocalAddr()
+}
+
+// RemoteAddr statifies the net.Conn interface
+func (p *dtlsPeer) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+// SetDeadline statifies the net.Conn interface
+func (p *dtlsPeer) SetDeadline(t time.Time) error {
+	p.readDeadline.Set(t)
+	return nil
+}
+
+// SetReadDeadline statifies the net.Conn interface
+func (p *dtlsPeer) SetReadDeadline(t time.Time) error {
+	p.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline statifies the net.Conn interface. Writes to the shared
+// connection do not block so the deadline is ignored
+func (p *dtlsPeer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// dtlsTimeoutError is returned when a deadline expires
+type dtlsTimeoutError struct{}
+
+func (dtlsTimeoutError) Error() string   { return "i/o timeout" }
+func (dtlsTimeoutError) Timeout() bool   { return true }
+func (dtlsTimeoutError) Temporary() bool { return true }
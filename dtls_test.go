@@ -0,0 +1,389 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert generates a certificate for 127.0.0.1 and a pool trusting it
+func selfSignedCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Error creating certificate:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// dtlsEcho starts a DTLS server echoing echoType and a client to call it with
+func dtlsEcho(t *testing.T, serverConfig DTLSConfig, clientConfig DTLSConfig) (PacketServer, PacketServer, PacketClient) {
+	t.Helper()
+	server, _, err := New("dtls", "127.0.0.1:0", WithDTLS(serverConfig))
+	if err != nil {
+		t.Fatal("Error creating dtls server:", err)
+	}
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go server.Serve(mux)
+	caller, client, err := New("dtls", "127.0.0.1:0", WithDTLS(clientConfig))
+	if err != nil {
+		t.Fatal("Error creating dtls client:", err)
+	}
+	go caller.Serve(NewPacketMux())
+	return server, caller, client
+}
+
+func TestDTLSTransport(t *testing.T) {
+	serverCert, serverRoots := selfSignedCert(t, "server")
+	clientCert, clientRoots := selfSignedCert(t, "client")
+	psk := func(hint []byte) ([]byte, error) {
+		return []byte("hacket pre-shared key"), nil
+	}
+	tests := []struct {
+		name   string
+		server DTLSConfig
+		client DTLSConfig
+	}{
+		{
+			name:   "certificate",
+			server: DTLSConfig{Certificates: []tls.Certificate{serverCert}},
+			client: DTLSConfig{RootCAs: serverRoots},
+		},
+		{
+			name: "mutual certificate",
+			server: DTLSConfig{
+				Certificates:      []tls.Certificate{serverCert},
+				ClientCAs:         clientRoots,
+				RequireClientCert: true,
+			},
+			client: DTLSConfig{Certificates: []tls.Certificate{clientCert}, RootCAs: serverRoots},
+		},
+		{
+			name:   "psk",
+			server: DTLSConfig{PSK: psk, PSKIdentityHint: []byte("hacket")},
+			client: DTLSConfig{PSK: psk, PSKIdentityHint: []byte("hacket")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, caller, client := dtlsEcho(t, tc.server, tc.client)
+			defer server.Shutdown(context.Background())
+			defer caller.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			msg, _ := NewPacketMessageBuilder([]byte("dtls")).WithPacketType(echoType).Build()
+			reply, err := client.(Caller).Call(ctx, msg, server.Addr())
+			if err != nil {
+				t.Fatal("Error calling dtls server:", err)
+			}
+			if string(reply.Msg()) != "dtls" {
+				t.Errorf("Expected dtls got %q", reply.Msg())
+			}
+			reply.Release()
+			if err := client.(ReliableWriter).WriteReliable(ctx, msg, server.Addr()); err != nil {
+				t.Error("Error writing reliably to dtls server:", err)
+			}
+		})
+	}
+}
+
+func TestDTLSTransportErrors(t *testing.T) {
+	if _, _, err := New("dtls", "127.0.0.1:0"); err != ErrDTLSConfigRequired {
+		t.Error("Expected ErrDTLSConfigRequired got", err)
+	}
+
+	serverCert, _ := selfSignedCert(t, "server")
+	_, untrusted := selfSignedCert(t, "untrusted")
+	server, caller, client := dtlsEcho(t,
+		DTLSConfig{Certificates: []tls.Certificate{serverCert}},
+		DTLSConfig{RootCAs: untrusted, HandshakeTimeout: time.Second},
+	)
+	defer server.Shutdown(context.Background())
+	defer caller.Shutdown(context.Background())
+	msg, _ := NewPacketMessageBuilder([]byte("dtls")).WithPacketType(echoType).Build()
+	if _, err := client.WriteTo(msg, server.Addr()); err == nil {
+		t.Error("Expected handshake with an untrusted certificate to fail")
+	}
+	if stats := server.Stats(); stats.PacketsReceived != 0 {
+		t.Error("Expected no packets to reach the server got", stats.PacketsReceived)
+	}
+}
+
+// newDTLSConn secures a udp socket on 127.0.0.1 with DTLS
+func newDTLSConn(t *testing.T, config DTLSConfig) *dtlsPacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	c := NewDTLSPacketConn(conn, config).(*dtlsPacketConn)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testClientHello returns a datagram starting with a ClientHello carrying random
+func testClientHello(random []byte) []byte {
+	b := make([]byte, 0, 64)
+	b = append(b, 22, 0xFE, 0xFD, 0, 0, 0, 0, 0, 0, 0, 0, 0, 46)
+	b = append(b, 1, 0, 0, 34, 0, 0, 0, 0, 0, 0, 0, 34)
+	b = append(b, 0xFE, 0xFD)
+	return append(b, random...)
+}
+
+func (c *dtlsPacketConn) peerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.peers)
+}
+
+func TestDTLSAccept(t *testing.T) {
+	c := newDTLSConn(t, DTLSConfig{HandshakeTimeout: time.Millisecond * 200})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	if _, ok := c.accept(addr, []byte("not a client hello")); ok || c.peerCount() != 0 {
+		t.Error("Expected datagrams other than a ClientHello not to start a handshake")
+	}
+	c.mu.Lock()
+	c.pending = maxDTLSPendingHandshakes
+	c.mu.Unlock()
+	if _, ok := c.accept(addr, testClientHello(bytes.Repeat([]byte{1}, 32))); ok {
+		t.Error("Expected handshakes beyond the pending limit to be refused")
+	}
+	c.mu.Lock()
+	c.pending = 0
+	c.mu.Unlock()
+	if _, ok := c.accept(addr, testClientHello(bytes.Repeat([]byte{1}, 32))); !ok || c.peerCount() != 1 {
+		t.Error("Expected a ClientHello to start a handshake")
+	}
+}
+
+func TestDTLSAcceptPerSource(t *testing.T) {
+	c := newDTLSConn(t, DTLSConfig{HandshakeTimeout: time.Millisecond * 200})
+	hello := testClientHello(bytes.Repeat([]byte{1}, 32))
+	for port := 1; port <= maxDTLSPendingPerSource; port++ {
+		if _, ok := c.accept(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}, hello); !ok {
+			t.Fatal("Expected a ClientHello to start a handshake")
+		}
+	}
+	if _, ok := c.accept(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9999}, hello); ok {
+		t.Error("Expected handshakes beyond the per source limit to be refused")
+	}
+	if _, ok := c.accept(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1}, hello); !ok {
+		t.Error("Expected a ClientHello from another source to start a handshake")
+	}
+	// the sources are free to handshake again once the handshakes time out
+	deadline := time.Now().Add(time.Second * 2)
+	for c.peerCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the handshakes to be abandoned")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, ok := c.accept(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9999}, hello); !ok {
+		t.Error("Expected a ClientHello to start a handshake once the pending ones were abandoned")
+	}
+}
+
+func TestDTLSAcceptCollision(t *testing.T) {
+	c := newDTLSConn(t, DTLSConfig{InsecureSkipVerify: true, HandshakeTimeout: time.Second})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	p, ok := c.dial(addr)
+	if !ok {
+		t.Fatal("Expected dial to start a handshake")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		sent := p.hello != nil
+		c.mu.Unlock()
+		if sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the ClientHello to be sent")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the peer sent the lower random so it yields
+	if _, ok := c.accept(addr, testClientHello(make([]byte, 32))); ok {
+		t.Error("Expected ClientHello with a lower random to be ignored")
+	}
+	// this connection sent the lower random so it accepts the peer's handshake
+	accepted, ok := c.accept(addr, testClientHello(bytes.Repeat([]byte{0xFF}, 32)))
+	if !ok || accepted == p || accepted.client {
+		t.Fatal("Expected ClientHello with a higher random to be accepted")
+	}
+	c.mu.Lock()
+	yielded := p.yielded
+	c.mu.Unlock()
+	if !yielded {
+		t.Error("Expected the handshake started by dial to yield")
+	}
+}
+
+func TestDTLSSimultaneousWrite(t *testing.T) {
+	cert, roots := selfSignedCert(t, "peer")
+	config := DTLSConfig{Certificates: []tls.Certificate{cert}, RootCAs: roots}
+	msg, _ := NewPacketMessageBuilder([]byte("dtls")).WithPacketType(echoType).Build()
+	for i := 0; i < 5; i++ {
+		received := make(chan struct{}, 2)
+		mux := NewPacketMux()
+		mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+			received <- struct{}{}
+		})
+		a, aClient, err := New("dtls", "127.0.0.1:0", WithDTLS(config))
+		if err != nil {
+			t.Fatal("Error creating dtls endpoint:", err)
+		}
+		b, bClient, err := New("dtls", "127.0.0.1:0", WithDTLS(config))
+		if err != nil {
+			t.Fatal("Error creating dtls endpoint:", err)
+		}
+		go a.Serve(mux)
+		go b.Serve(mux)
+
+		errs := make(chan error, 2)
+		go func() {
+			_, err := aClient.WriteTo(msg, b.Addr())
+			errs <- err
+		}()
+		go func() {
+			_, err := bClient.WriteTo(msg, a.Addr())
+			errs <- err
+		}()
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				t.Error("Error writing to each other at once:", err)
+			}
+		}
+		for j := 0; j < 2; j++ {
+			select {
+			case <-received:
+			case <-time.After(time.Second * 5):
+				t.Fatal("Timed out waiting for message")
+			}
+		}
+		a.Shutdown(context.Background())
+		b.Shutdown(context.Background())
+	}
+}
+
+func TestDTLSIdleTimeout(t *testing.T) {
+	cert, roots := selfSignedCert(t, "server")
+	serverConn := newDTLSConn(t, DTLSConfig{Certificates: []tls.Certificate{cert}, IdleTimeout: time.Millisecond * 200})
+	server, _, err := NewFromConn(serverConn)
+	if err != nil {
+		t.Fatal("Error creating dtls server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go server.Serve(mux)
+	callerConn := newDTLSConn(t, DTLSConfig{RootCAs: roots})
+	caller, client, err := NewFromConn(callerConn)
+	if err != nil {
+		t.Fatal("Error creating dtls client:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	msg, _ := NewPacketMessageBuilder([]byte("dtls")).WithPacketType(echoType).Build()
+	for i := 0; i < 2; i++ {
+		reply, err := client.(Caller).Call(ctx, msg, server.Addr())
+		if err != nil {
+			t.Fatal("Error calling dtls server:", err)
+		}
+		reply.Release()
+		// both peers forget the session once it is closed for being idle
+		deadline := time.Now().Add(time.Second * 2)
+		for serverConn.peerCount() != 0 || callerConn.peerCount() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the idle session to be closed")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestDTLSClientRestart(t *testing.T) {
+	cert, roots := selfSignedCert(t, "server")
+	serverConn := newDTLSConn(t, DTLSConfig{Certificates: []tls.Certificate{cert}})
+	server, _, err := NewFromConn(serverConn)
+	if err != nil {
+		t.Fatal("Error creating dtls server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go server.Serve(mux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	msg, _ := NewPacketMessageBuilder([]byte("dtls")).WithPacketType(echoType).Build()
+	addr := "127.0.0.1:0"
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal("Error listening:", err)
+		}
+		addr = conn.LocalAddr().String()
+		caller, client, err := NewFromConn(NewDTLSPacketConn(conn, DTLSConfig{RootCAs: roots}))
+		if err != nil {
+			t.Fatal("Error creating dtls client:", err)
+		}
+		go caller.Serve(NewPacketMux())
+		reply, err := client.(Caller).Call(ctx, msg, server.Addr())
+		if err != nil {
+			t.Fatal("Error calling dtls server:", err)
+		}
+		reply.Release()
+		// the client crashes without closing its session, and restarts on the
+		// same address
+		conn.Close()
+		caller.Shutdown(context.Background())
+	}
+	if n := serverConn.peerCount(); n != 1 {
+		t.Error("Expected the restarted session to replace the old one got", n)
+	}
+}
@@ -0,0 +1,253 @@
+package hacket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// frameType identifies the datagrams that hacket uses internally to carry
+// protocol state, such as call correlation IDs. Frames start with headerEscape
+// followed by the frameType, so they never take a PacketType. Frame types are
+// at least frameTypeFirst so they are never confused with a header version.
+type frameType uint8
+
+const (
+	// frameHeaderSize is the size of headerEscape and the frameType
+	frameHeaderSize = 1 + 1
+	// frameTypeFirst is the lowest frameType, lower values are header versions
+	frameTypeFirst frameType = 0x80
+)
+
+const (
+	// frameCallRequest wraps a PacketMessage sent with PacketClient.Call
+	frameCallRequest frameType = 0xF0
+	// frameCallResponse wraps the reply written by the handler of a call request
+	frameCallResponse frameType = 0xF1
+	// frameReliable wraps a PacketMessage sent with WriteReliable
+	frameReliable frameType = 0xF2
+	// frameAck acknowledges a reliable message
+	frameAck frameType = 0xF3
+	// frameFragment carries one piece of a message that was too large for a single datagram
+	frameFragment frameType = 0xF4
+	// frameTrace carries the SpanContext of the sender for distributed tracing
+	frameTrace frameType = 0xF5
+	// frameSealed carries a datagram encrypted with a key from the Keyring
+	frameSealed frameType = 0xF6
+	// frameNoise carries Noise handshake and transport messages
+	frameNoise frameType = 0xF7
+)
+
+// putFrameHeader writes the header of a frame of type ft to the start of b
+func putFrameHeader(b []byte, ft frameType) {
+	b[0] = headerEscape
+	b[1] = uint8(ft)
+}
+
+// frameOf returns the type of the frame in b. It returns false when b is a
+// PacketMessage rather than a frame
+func frameOf(b []byte) (frameType, bool) {
+	if len(b) < frameHeaderSize || b[0] != headerEscape || frameType(b[1]) < frameTypeFirst {
+		return 0, false
+	}
+	return frameType(b[1]), true
+}
+
+// endpoint holds the state shared by the PacketServer, PacketClient and
+// PacketWriters created from a single connection
+type endpoint struct {
+	conn     net.PacketConn
+	options  *packetOptions
+	calls    *callRegistry
+	reliable *reliableState
+	replay   *replayState
+	mon      *monitor
+	// batch is set for connections that support reading and writing in batches
+	batch batchConn
+	// writer is the PacketWriter shared by handlers that are not replying to a call
+	writer *hacketPacketWriter
+	// noise is set when Noise handshakes are enabled
+	noise *noiseState
+
+	fragmentMu  sync.Mutex
+	fragmentID  uint32
+	reassembler *reassembler
+}
+
+// newEndpoint creates an endpoint for conn
+func newEndpoint(conn net.PacketConn, options *packetOptions) (*endpoint, error) {
+	reliable, err := newReliableState()
+	if err != nil {
+		return nil, err
+	}
+	replay, err := newReplayState()
+	if err != nil {
+		return nil, err
+	}
+	ep := &endpoint{
+		conn:     conn,
+		options:  options,
+		calls:    newCallRegistry(),
+		reliable: reliable,
+		replay:   replay,
+		mon:      newMonitor(options),
+	}
+	ep.writer = &hacketPacketWriter{ep: ep}
+	if options.Noise != nil {
+		if ep.noise, err = newNoiseState(*options.Noise); err != nil {
+			return nil, err
+		}
+	}
+	if batch, ok := newBatchConn(conn); ok {
+		ep.batch = batch
+	}
+	if options.FragmentSize > 0 {
+		// start message IDs at a random offset so a restarted peer does not
+		// collide with fragments that are still being reassembled
+		var id [4]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		ep.fragmentID = binary.BigEndian.Uint32(id[:])
+		ep.reassembler = newReassembler(options.ReassemblyTimeout, options.MaxReassemblyBytes)
+	}
+	return ep, nil
+}
+
+// writeTo writes b to addr, splitting it into fragments when fragmentation is
+// enabled and b does not fit in a single fragment
+func (ep *endpoint) writeTo(b []byte, addr net.Addr) (int, error) {
+	if ep.options.FragmentSize > 0 && len(b)+ep.sealOverhead() > ep.options.FragmentSize {
+		return ep.writeFragmented(b, addr)
+	}
+	return ep.writeDatagram(b, addr)
+}
+
+// writeDatagram writes b to addr as a single datagram applying the configured write deadline
+func (ep *endpoint) writeDatagram(b []byte, addr net.Addr) (int, error) {
+	datagram, err := ep.seal(b, addr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ep.writeRaw(datagram, addr)
+	if err == nil && len(datagram) != len(b) {
+		// report the size of the message rather than the sealed frame
+		n = len(b)
+	}
+	return n, err
+}
+
+// writeRaw writes b to addr as is applying the configured write deadline
+func (ep *endpoint) writeRaw(b []byte, addr net.Addr) (int, error) {
+	if ep.options.WriteDeadline > 0 {
+		deadline := time.Now().Add(ep.options.WriteDeadline)
+		if err := ep.conn.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err := ep.conn.WriteTo(b, addr)
+	ep.mon.sent(n, err)
+	return n, err
+}
+
+// ingress unwraps internal frames from an incoming packet. When the packet is
+// destined for a PacketHandler the unwrapped packet and the PacketWriter the
+// handler should reply with are returned. Packets consumed by hacket itself,
+// such as call responses, return false.
+func (ep *endpoint) ingress(packet Packet) (Packet, PacketWriter, bool) {
+	msg := packet.Msg()
+	ft, ok := frameOf(msg)
+	if !ok {
+		return packet, ep.writer, true
+	}
+	switch ft {
+	case frameCallRequest:
+		id, body, err := decodeCallFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		packet.SetMsg(body)
+		return packet, &callPacketWriter{ep: ep, id: id, addr: packet.FromAddr()}, true
+	case frameCallResponse:
+		id, body, err := decodeCallFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		packet.SetMsg(body)
+		if err := ep.calls.resolve(id, packet); err != nil {
+			ep.unmatchedReply(packet, err)
+		}
+		return packet, nil, false
+	case frameReliable:
+		session, seq, body, err := decodeReliableFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		// Always acknowledge so retransmissions stop when an earlier ack was lost
+		if _, err := ep.writeTo(encodeAckFrame(session, seq), packet.FromAddr()); err != nil {
+			ep.mon.logger.Log(LevelWarn, "acknowledgement failed", "to", packet.FromAddr(), "err", err)
+			return packet, nil, false
+		}
+		if !ep.reliable.accept(packet.FromAddr(), session, seq, ep.duplicateTTL()) {
+			ep.mon.drops.drop(packet, DropReasonDuplicate)
+			return packet, nil, false
+		}
+		packet.SetMsg(body)
+		return ep.ingress(packet)
+	case frameAck:
+		session, seq, err := decodeAckFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		ep.reliable.ack(session, seq, packet.FromAddr())
+		return packet, nil, false
+	case frameFragment:
+		if ep.reassembler == nil {
+			ep.mon.malformed(packet, ErrFragmentationDisabled)
+			return packet, nil, false
+		}
+		id, index, count, chunk, err := decodeFragmentFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		body, ok := ep.reassembler.add(packet.FromAddr(), id, index, count, chunk, packet.Timestamp())
+		if !ok {
+			return packet, nil, false
+		}
+		packet.SetMsg(body)
+		return ep.ingress(packet)
+	case frameTrace:
+		sc, body, err := decodeTraceFrame(msg)
+		if err != nil {
+			ep.mon.malformed(packet, err)
+			return packet, nil, false
+		}
+		packet.ctx = ContextWithSpanContext(packet.Context(), sc)
+		packet.SetMsg(body)
+		return ep.ingress(packet)
+	case frameSealed, frameNoise:
+		// sealed and noise frames are opened before ingress, so this one is
+		// nested or arrived without a Keyring or Noise configured
+		ep.mon.drops.drop(packet, DropReasonUnauthenticated)
+		return packet, nil, false
+	default:
+		ep.mon.malformed(packet, ErrUnknownFrameType)
+		return packet, nil, false
+	}
+}
+
+// unmatchedReply reports a call reply that does not match a waiting Call
+func (ep *endpoint) unmatchedReply(packet Packet, err error) {
+	if ep.options.UnmatchedReplyHandler != nil {
+		ep.options.UnmatchedReplyHandler(packet, err)
+		return
+	}
+	ep.mon.logger.Log(LevelWarn, "unmatched call reply", "from", packet.FromAddr(), "err", err)
+}
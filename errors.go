@@ -32,4 +32,140 @@ var (
 
 	//ErrNilConn is returned when trying to use the server with a nil connection
 	ErrNilConn = errors.New("no packet connection")
+
+	// ErrNilTransport cannot register a nil transport
+	ErrNilTransport = errors.New("nil transport")
+
+	// ErrTransportAlreadyExists cannot register transport because the network name is in use
+	ErrTransportAlreadyExists = errors.New("transport already exists with supplied network")
+
+	// ErrShortPacket packet is too short to contain the expected header
+	ErrShortPacket = errors.New("packet is too short")
+
+	// ErrLateReply reply received for a call that is no longer waiting
+	ErrLateReply = errors.New("reply received after call completed")
+
+	// ErrUnmatchedReply reply received with a correlation ID that was never issued to its sender
+	ErrUnmatchedReply = errors.New("reply does not match any call")
+
+	// ErrDeliveryFailed reliable message was not acknowledged after all transmissions
+	ErrDeliveryFailed = errors.New("reliable message was not acknowledged")
+
+	// ErrFragmentSize fragment size is too small to hold the fragment header and any data
+	ErrFragmentSize = errors.New("fragment size too small")
+
+	// ErrNotErrorPacket message is not a PacketTypeError message
+	ErrNotErrorPacket = errors.New("message is not an error packet")
+
+	// ErrFragmentationDisabled fragment received without fragmentation enabled
+	ErrFragmentationDisabled = errors.New("fragment received but fragmentation is disabled")
+
+	// ErrInvalidSpanContext trace header with a zero trace or span ID
+	ErrInvalidSpanContext = errors.New("invalid span context")
+
+	// ErrNilCodec codec is nil
+	ErrNilCodec = errors.New("nil codec")
+
+	// ErrInvalidTypedHandler typed handler is not a func(Packet, PacketWriter, T)
+	ErrInvalidTypedHandler = errors.New("typed handler must be a func(hacket.Packet, hacket.PacketWriter, T)")
+
+	// ErrNotProtoMessage value does not implement ProtoMessage
+	ErrNotProtoMessage = errors.New("value does not implement hacket.ProtoMessage")
+
+	// ErrUnsupportedHeaderVersion message header version is newer than this version of hacket
+	ErrUnsupportedHeaderVersion = errors.New("unsupported header version")
+
+	// ErrUnsupportedHeaderFlags message header has flags this version of hacket does not understand
+	ErrUnsupportedHeaderFlags = errors.New("unsupported header flags")
+
+	// ErrChecksumMismatch message checksum does not match its contents
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrChecksumRequired message without a checksum for a PacketType that requires one
+	ErrChecksumRequired = errors.New("checksum required")
+
+	// ErrInvalidKeySize encryption keys must be 32 bytes
+	ErrInvalidKeySize = errors.New("encryption key must be 32 bytes")
+
+	// ErrUnknownCipher cipher is not supported
+	ErrUnknownCipher = errors.New("unknown cipher")
+
+	// ErrKeyAlreadyExists a key with the ID is already in the keyring
+	ErrKeyAlreadyExists = errors.New("key already exists with supplied id")
+
+	// ErrKeyNotFound no key with the ID is in the keyring
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrPrimaryKey the primary key cannot be removed
+	ErrPrimaryKey = errors.New("cannot remove the primary key")
+
+	// ErrUnauthenticated packet could not be authenticated with the keyring
+	ErrUnauthenticated = errors.New("packet could not be authenticated")
+
+	// ErrReplayedPacket sealed packet was already received
+	ErrReplayedPacket = errors.New("replayed packet")
+
+	// ErrStalePacket sealed packet is older than the replay window
+	ErrStalePacket = errors.New("stale packet")
+
+	// ErrTooManySessions too many peer sessions are active to track replays for a new one
+	ErrTooManySessions = errors.New("too many active sessions")
+
+	// ErrNoiseDisabled handshake attempted on an endpoint created without WithNoise
+	ErrNoiseDisabled = errors.New("noise handshakes are not enabled")
+
+	// ErrUnknownNoisePattern handshake pattern is not supported
+	ErrUnknownNoisePattern = errors.New("unknown noise handshake pattern")
+
+	// ErrUnknownNoiseMessage noise frame has an unknown message kind
+	ErrUnknownNoiseMessage = errors.New("unknown noise message")
+
+	// ErrUnknownNoiseSession noise message for a session or handshake that does not exist
+	ErrUnknownNoiseSession = errors.New("unknown noise session")
+
+	// ErrPeerStaticKeyRequired the IK pattern requires the static key of the peer
+	ErrPeerStaticKeyRequired = errors.New("peer static key is required")
+
+	// ErrPeerStaticKeyMismatch peer completed the handshake with an unexpected static key
+	ErrPeerStaticKeyMismatch = errors.New("peer static key does not match")
+
+	// ErrPeerNotAuthorized peer static key was rejected by NoiseConfig.Authorize
+	ErrPeerNotAuthorized = errors.New("peer is not authorized")
+
+	// ErrReplayedHandshake noise init message is not newer than the last one from the peer
+	ErrReplayedHandshake = errors.New("replayed noise handshake")
+
+	// ErrTooManyHandshakes too many handshakes are in progress to start another
+	ErrTooManyHandshakes = errors.New("too many handshakes in progress")
+
+	// ErrHandshakeTimeout handshake did not complete within the handshake timeout
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+
+	// ErrNoiseSessionRequired write to a peer without a noise session when plaintext is not allowed
+	ErrNoiseSessionRequired = errors.New("no noise session with peer")
+
+	// ErrMissingAddr packet does not have a remote address
+	ErrMissingAddr = errors.New("packet does not have a remote address")
+
+	// ErrDTLSConfigRequired the dtls networks must be configured with WithDTLS
+	ErrDTLSConfigRequired = errors.New("dtls transport requires WithDTLS")
+
+	// ErrDTLSConnClosed dtls connection has been closed
+	ErrDTLSConnClosed = errors.New("use of closed dtls connection")
+
+	// ErrTooManyDTLSPeers too many dtls sessions are active to establish another
+	ErrTooManyDTLSPeers = errors.New("too many dtls sessions")
+
+	// ErrUnknownFrameType message is an internal frame this version of hacket does not understand
+	ErrUnknownFrameType = errors.New("unknown frame type")
+
+	// ErrConflictingOptions ordered dispatch was combined with an overload
+	// policy, priorities or reserved concurrency, which it does not apply
+	ErrConflictingOptions = errors.New("ordered dispatch can not be combined with an overload policy, priorities or reserved concurrency")
+
+	// ErrUnsupportedPeerQueuePolicy ordered dispatch does not shed packets by PacketType
+	ErrUnsupportedPeerQueuePolicy = errors.New("ordered dispatch does not support OverflowShed")
+
+	// ErrNoPort the local address of the connection does not have a port
+	ErrNoPort = errors.New("local address does not have a port")
 )
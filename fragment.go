@@ -0,0 +1,192 @@
+package hacket
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	// fragmentHeaderSize is the size of the frame type, message ID, fragment
+	// index and fragment count prepended to each fragment
+	fragmentHeaderSize = frameHeaderSize + 4 + 2 + 2
+	// maxFragments is the largest number of fragments a message can be split into
+	maxFragments = 1<<16 - 1
+	// fragmentSlotSize is the memory used to track each fragment of a partial
+	// message, which is charged against the reassembly limit so that small
+	// fragments claiming a large count cannot exhaust memory
+	fragmentSlotSize = int(unsafe.Sizeof([]byte(nil)))
+)
+
+// fragmentKey identifies a message being reassembled
+type fragmentKey struct {
+	addr string
+	id   uint32
+}
+
+// partialMessage holds the fragments of a message that has not been fully received
+type partialMessage struct {
+	key       fragmentKey
+	fragments [][]byte
+	received  int
+	length    int // length of the fragments received
+	size      int // bytes charged against the reassembly limit
+	created   time.Time
+	elem      *list.Element
+}
+
+// reassembler buffers fragments until every fragment of a message has been
+// received. Incomplete messages expire after a timeout and the total number of
+// buffered bytes is bounded, evicting the oldest incomplete messages first.
+type reassembler struct {
+	timeout  time.Duration
+	maxBytes int
+
+	mu       sync.Mutex
+	partials map[fragmentKey]*partialMessage
+	order    *list.List // partialMessages ordered oldest first
+	size     int
+}
+
+func newReassembler(timeout time.Duration, maxBytes int) *reassembler {
+	return &reassembler{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		partials: make(map[fragmentKey]*partialMessage),
+		order:    list.New(),
+	}
+}
+
+// add buffers a fragment received from addr and returns the reassembled message
+// once every fragment has arrived
+func (r *reassembler) add(addr net.Addr, id uint32, index uint16, count uint16, chunk []byte, now time.Time) (PacketMessage, bool) {
+	if count == 0 || index >= count || len(chunk) == 0 || int(count)*(len(chunk)+fragmentSlotSize) > r.maxBytes {
+		return nil, false
+	}
+	key := fragmentKey{id: id}
+	if addr != nil {
+		key.addr = addr.String()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+
+	partial, ok := r.partials[key]
+	if ok && len(partial.fragments) != int(count) {
+		// message ID was reused with a different layout, start over
+		r.remove(partial)
+		ok = false
+	}
+	if !ok {
+		partial = &partialMessage{key: key, fragments: make([][]byte, count), created: now}
+		partial.size = int(count) * fragmentSlotSize
+		partial.elem = r.order.PushBack(partial)
+		r.partials[key] = partial
+		r.size += partial.size
+	}
+	if partial.fragments[index] != nil {
+		return nil, false
+	}
+	// copy the chunk so the read buffer it arrived in is not retained
+	stored := make([]byte, len(chunk))
+	copy(stored, chunk)
+	partial.fragments[index] = stored
+	partial.received++
+	partial.length += len(chunk)
+	partial.size += len(chunk)
+	r.size += len(chunk)
+
+	if partial.received == len(partial.fragments) {
+		r.remove(partial)
+		msg := make(PacketMessage, 0, partial.length)
+		for _, fragment := range partial.fragments {
+			msg = append(msg, fragment...)
+		}
+		return msg, true
+	}
+	for r.size > r.maxBytes && r.order.Len() > 0 {
+		r.remove(r.order.Front().Value.(*partialMessage))
+	}
+	return nil, false
+}
+
+// expire removes incomplete messages older than the reassembly timeout
+func (r *reassembler) expire(now time.Time) {
+	for r.order.Len() > 0 {
+		oldest := r.order.Front().Value.(*partialMessage)
+		if now.Sub(oldest.created) < r.timeout {
+			return
+		}
+		r.remove(oldest)
+	}
+}
+
+// remove discards an incomplete message
+func (r *reassembler) remove(partial *partialMessage) {
+	r.order.Remove(partial.elem)
+	delete(r.partials, partial.key)
+	r.size -= partial.size
+}
+
+// fragment splits msg into frames no larger than fragmentSize
+func fragment(id uint32, msg []byte, fragmentSize int) ([]PacketMessage, error) {
+	chunkSize := fragmentSize - fragmentHeaderSize
+	if chunkSize < 1 {
+		return nil, ErrFragmentSize
+	}
+	count := (len(msg) + chunkSize - 1) / chunkSize
+	if count > maxFragments {
+		return nil, ErrMaxMessageSize
+	}
+	frames := make([]PacketMessage, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk := msg[index*chunkSize : end]
+		frame := make(PacketMessage, fragmentHeaderSize+len(chunk))
+		putFrameHeader(frame, frameFragment)
+		binary.BigEndian.PutUint32(frame[2:6], id)
+		binary.BigEndian.PutUint16(frame[6:8], uint16(index))
+		binary.BigEndian.PutUint16(frame[8:10], uint16(count))
+		copy(frame[fragmentHeaderSize:], chunk)
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// decodeFragmentFrame returns the message ID, index, count and chunk carried by a fragment
+func decodeFragmentFrame(b []byte) (uint32, uint16, uint16, []byte, error) {
+	if len(b) < fragmentHeaderSize {
+		return 0, 0, 0, nil, ErrShortPacket
+	}
+	id := binary.BigEndian.Uint32(b[2:6])
+	index := binary.BigEndian.Uint16(b[6:8])
+	count := binary.BigEndian.Uint16(b[8:10])
+	return id, index, count, b[fragmentHeaderSize:], nil
+}
+
+// writeFragmented writes msg to addr as a series of fragments. The length of msg
+// is returned once every fragment has been written
+func (ep *endpoint) writeFragmented(msg []byte, addr net.Addr) (int, error) {
+	ep.fragmentMu.Lock()
+	ep.fragmentID++
+	id := ep.fragmentID
+	ep.fragmentMu.Unlock()
+
+	// leave room for seal to encrypt each fragment
+	frames, err := fragment(id, msg, ep.options.FragmentSize-ep.sealOverhead())
+	if err != nil {
+		return 0, err
+	}
+	for _, frame := range frames {
+		if _, err := ep.writeDatagram(frame, addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(msg), nil
+}
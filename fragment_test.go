@@ -0,0 +1,167 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFragmentation(t *testing.T) {
+	receiver, _, err := New("udp", "127.0.0.1:0", WithFragmentation(1200))
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer receiver.Shutdown(context.Background())
+	received := make(chan PacketMessage, 1)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		received <- packet.Msg()
+	})
+	go receiver.Serve(mux)
+
+	sender, client, err := New("udp", "127.0.0.1:0", WithFragmentation(1200))
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer sender.Shutdown(context.Background())
+
+	payload := bytes.Repeat([]byte("0123456789"), 7000)
+	if _, err := NewPacketMessageBuilder(payload).Build(); err != ErrMaxMessageSize {
+		t.Fatal("Expected max message size error, received:", err)
+	}
+	msg, err := NewPacketMessageBuilder(payload).WithPacketType(PacketType(1)).WithMaxMessageSize(len(payload) + 1).Build()
+	if err != nil {
+		t.Fatal("Error building message:", err)
+	}
+	n, err := client.WriteTo(msg, receiver.Addr())
+	if err != nil {
+		t.Fatal("Error writing fragmented message:", err)
+	}
+	if n != len(msg) {
+		t.Errorf("Expected %d bytes written, wrote %d", len(msg), n)
+	}
+	select {
+	case body := <-received:
+		if !bytes.Equal(body, payload) {
+			t.Error("Reassembled message does not match")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for reassembled message")
+	}
+}
+
+func TestReassemblerExpiry(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	frames, err := fragment(1, bytes.Repeat([]byte("a"), 30), 20)
+	if err != nil {
+		t.Fatal("Error fragmenting message:", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 fragments, received %d", len(frames))
+	}
+	r := newReassembler(time.Second, 1024)
+	now := time.Now()
+	for _, frame := range frames[:2] {
+		id, index, count, chunk, _ := decodeFragmentFrame(frame)
+		if _, ok := r.add(addr, id, index, count, chunk, now); ok {
+			t.Fatal("Message completed early")
+		}
+	}
+	// the final fragment arrives after the incomplete message expired
+	id, index, count, chunk, _ := decodeFragmentFrame(frames[2])
+	if _, ok := r.add(addr, id, index, count, chunk, now.Add(time.Second*2)); ok {
+		t.Error("Expected expired message to be discarded")
+	}
+	if want := len(chunk) + int(count)*fragmentSlotSize; r.size != want {
+		t.Errorf("Expected only the latest fragment to be buffered, buffered %d bytes want %d", r.size, want)
+	}
+}
+
+func TestReassemblerMaxBytes(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	// room for two partial messages of two fragments with one 10 byte fragment received
+	maxBytes := 2 * (2*fragmentSlotSize + 10)
+	r := newReassembler(time.Minute, maxBytes)
+	now := time.Now()
+	for id := uint32(1); id <= 3; id++ {
+		r.add(addr, id, 0, 2, bytes.Repeat([]byte("a"), 10), now)
+	}
+	if r.size > maxBytes {
+		t.Errorf("Expected at most %d bytes buffered, buffered %d", maxBytes, r.size)
+	}
+	if len(r.partials) != 2 {
+		t.Errorf("Expected 2 partial messages buffered, buffered %d", len(r.partials))
+	}
+	if _, ok := r.partials[fragmentKey{addr: addr.String(), id: 1}]; ok {
+		t.Error("Expected oldest message to be evicted")
+	}
+}
+
+func TestReassemblerRejectsEmptyFragments(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	r := newReassembler(time.Minute, 1<<20)
+	now := time.Now()
+	// a single empty fragment claiming the maximum count must not allocate the fragment table
+	if _, ok := r.add(addr, 1, 0, maxFragments, nil, now); ok {
+		t.Fatal("Expected empty fragment to be rejected")
+	}
+	if len(r.partials) != 0 || r.size != 0 {
+		t.Errorf("Expected nothing buffered, buffered %d messages and %d bytes", len(r.partials), r.size)
+	}
+	if _, ok := r.add(addr, 2, 0, maxFragments, []byte("a"), now); ok || len(r.partials) != 0 {
+		t.Error("Expected fragment table larger than the reassembly limit to be rejected")
+	}
+}
+
+func TestSealedFragmentsFitFragmentSize(t *testing.T) {
+	const fragmentSize = 200
+	keyring := NewKeyring()
+	if err := keyring.AddKey(1, CipherXChaCha20Poly1305, testKey(1)); err != nil {
+		t.Fatal("Error adding key:", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer conn.Close()
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer receiver.Close()
+	options, err := newPacketOptions([]Options{WithKeyring(keyring), WithFragmentation(fragmentSize)})
+	if err != nil {
+		t.Fatal("Error applying options:", err)
+	}
+	ep, err := newEndpoint(conn, options)
+	if err != nil {
+		t.Fatal("Error creating endpoint:", err)
+	}
+
+	chunkSize := fragmentSize - keyringSealOverhead - fragmentHeaderSize
+	testcases := []struct {
+		size      int
+		datagrams int
+	}{
+		{size: fragmentSize - keyringSealOverhead, datagrams: 1},
+		{size: 1000, datagrams: (1000 + chunkSize - 1) / chunkSize},
+	}
+	buf := make([]byte, 2*fragmentSize)
+	for _, tt := range testcases {
+		if _, err := ep.writeTo(bytes.Repeat([]byte("a"), tt.size), receiver.LocalAddr()); err != nil {
+			t.Fatal("Error writing:", err)
+		}
+		for i := 0; i < tt.datagrams; i++ {
+			receiver.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := receiver.ReadFrom(buf)
+			if err != nil {
+				t.Fatal("Error reading datagram:", err)
+			}
+			if n > fragmentSize {
+				t.Fatalf("Expected datagrams of at most %d bytes, received %d", fragmentSize, n)
+			}
+		}
+	}
+}
@@ -1,3 +1,20 @@
 module github.com/elewis787/hacket
 
-go 1.13
+go 1.18
+
+require (
+	github.com/flynn/noise v1.1.0
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/pion/dtls/v2 v2.2.12
+	github.com/pion/transport/v2 v2.2.4
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.18.0
+	golang.org/x/net v0.20.0
+)
+
+require (
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
@@ -4,38 +4,106 @@ import (
 	"net"
 )
 
-// New initializes a packet server and a packet client
+// readBufferSetter is implemented by connections that allow the operating
+// system's receive buffer to be sized, such as *net.UDPConn and *net.UnixConn
+type readBufferSetter interface {
+	SetReadBuffer(bytes int) error
+}
+
+// writeBufferSetter is implemented by connections that allow the operating
+// system's transmit buffer to be sized, such as *net.UDPConn and *net.UnixConn
+type writeBufferSetter interface {
+	SetWriteBuffer(bytes int) error
+}
+
+// New initializes a packet server and a packet client. The network must be one
+// of "udp", "udp4", "udp6", "unixgram", "dtls", "dtls4", "dtls6" or a network
+// added with RegisterTransport. The dtls networks must be configured with WithDTLS
 func New(network string, address string, options ...Options) (PacketServer, PacketClient, error) {
 	// Setup the connection based on the network protocol
-	switch network {
-	case "udp":
-		udpOptions := defaultPacketOption()
-		// set all options if supplied
-		for _, opt := range options {
-			opt.apply(udpOptions)
-		}
-		udpAddr, err := net.ResolveUDPAddr(network, address)
-		if err != nil {
-			return nil, nil, err
+	transport, ok := lookupTransport(network)
+	if !ok {
+		return nil, nil, ErrInvalidProtocol
+	}
+	packetOptions, err := newPacketOptions(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conn net.PacketConn
+	if ot, ok := transport.(optionsTransport); ok {
+		conn, err = ot.listenWithOptions(network, address, packetOptions)
+	} else {
+		conn, err = transport.Listen(network, address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	server, client, err := NewFromConn(conn, options...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return server, client, nil
+}
+
+// NewFromConn initializes a packet server and a packet client that share an
+// existing connection. This allows sockets that were created elsewhere, such as
+// by systemd socket activation or a test harness, to be served by a PacketMux.
+// The server takes ownership of conn and closes it during Shutdown
+func NewFromConn(conn net.PacketConn, options ...Options) (PacketServer, PacketClient, error) {
+	if conn == nil {
+		return nil, nil, ErrMissingPacketConn
+	}
+	packetOptions, err := newPacketOptions(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := applyBufferSizes(conn, packetOptions); err != nil {
+		return nil, nil, err
+	}
+	ep, err := newEndpoint(conn, packetOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := newPacketServer(ep)
+	client := newPacketClient(ep)
+	return server, client, nil
+}
+
+// newPacketOptions applies options to the default options and rejects
+// combinations of options that can not be honoured together
+func newPacketOptions(options []Options) (*packetOptions, error) {
+	packetOptions := defaultPacketOption()
+	// set all options if supplied
+	for _, opt := range options {
+		opt.apply(packetOptions)
+	}
+	if packetOptions.PeerQueueSize > 0 {
+		if packetOptions.Overload || len(packetOptions.Priorities) > 0 || packetOptions.ReservedConcurrency > 0 {
+			return nil, ErrConflictingOptions
 		}
-		conn, err := net.ListenUDP(network, udpAddr)
-		if err != nil {
-			return nil, nil, err
+		if packetOptions.PeerQueuePolicy == OverflowShed {
+			return nil, ErrUnsupportedPeerQueuePolicy
 		}
-		if udpOptions.ReadBufferSize > 0 {
-			if err := conn.SetReadBuffer(udpOptions.ReadBufferSize); err != nil {
-				return nil, nil, err
+	}
+	return packetOptions, nil
+}
+
+// applyBufferSizes sets the socket buffer sizes when supplied and supported by conn
+func applyBufferSizes(conn net.PacketConn, options *packetOptions) error {
+	if options.ReadBufferSize > 0 {
+		if rbs, ok := conn.(readBufferSetter); ok {
+			if err := rbs.SetReadBuffer(options.ReadBufferSize); err != nil {
+				return err
 			}
 		}
-		if udpOptions.WriteBufferSize > 0 {
-			if err := conn.SetWriteBuffer(udpOptions.WriteBufferSize); err != nil {
-				return nil, nil, err
+	}
+	if options.WriteBufferSize > 0 {
+		if wbs, ok := conn.(writeBufferSetter); ok {
+			if err := wbs.SetWriteBuffer(options.WriteBufferSize); err != nil {
+				return err
 			}
 		}
-		udpServer := newUDPPacketServer(conn, udpOptions)
-		udpClient := newUDPPacketClient(conn, udpOptions)
-		return udpServer, udpClient, nil
-	default:
-		return nil, nil, ErrInvalidProtocol
 	}
+	return nil
 }
@@ -0,0 +1,165 @@
+package hacket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elewis787/hacket/internal/mocks"
+)
+
+func TestNewInvalidProtocol(t *testing.T) {
+	if _, _, err := New("tcp", "127.0.0.1:0"); err != ErrInvalidProtocol {
+		t.Fatal("Expected invalid protocol error, received:", err)
+	}
+}
+
+func TestNewUDPNetworks(t *testing.T) {
+	testcases := []struct {
+		name    string
+		network string
+		address string
+	}{
+		{name: "test-new-udp", network: "udp", address: "127.0.0.1:0"},
+		{name: "test-new-udp4", network: "udp4", address: "127.0.0.1:0"},
+		{name: "test-new-udp6", network: "udp6", address: "[::1]:0"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, err := New(tt.network, tt.address)
+			if err != nil {
+				t.Skip("Network unavailable:", err)
+			}
+			defer server.Shutdown(context.Background())
+			port, err := server.Port()
+			if err != nil {
+				t.Fatal("Error reading port:", err)
+			}
+			if port == 0 {
+				t.Error("Expected auto bound port")
+			}
+		})
+	}
+}
+
+func TestNewUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hacket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverPath := filepath.Join(dir, "server.sock")
+	clientPath := filepath.Join(dir, "client.sock")
+	server, _, err := New("unixgram", serverPath)
+	if err != nil {
+		t.Fatal("Error creating unixgram server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	if _, err := server.Port(); err != ErrNoPort {
+		t.Error("Expected no port error, received:", err)
+	}
+	clientServer, client, err := New("unixgram", clientPath)
+	if err != nil {
+		t.Fatal("Error creating unixgram client:", err)
+	}
+	defer clientServer.Shutdown(context.Background())
+
+	received := make(chan string, 1)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		received <- string(packet.Msg())
+	})
+	go server.Serve(mux)
+
+	msg, _ := NewPacketMessageBuilder([]byte("hello")).WithPacketType(PacketType(1)).Build()
+	if _, err := client.WriteTo(msg, server.Addr()); err != nil {
+		t.Fatal("Error writing to unixgram server:", err)
+	}
+	select {
+	case body := <-received:
+		if body != "hello" {
+			t.Error("Unexpected message:", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for unixgram packet")
+	}
+
+	server.Shutdown(context.Background())
+	if _, err := os.Stat(serverPath); !os.IsNotExist(err) {
+		t.Error("Expected socket file to be removed on shutdown, received:", err)
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	listened := false
+	transport := TransportFunc(func(network string, address string) (net.PacketConn, error) {
+		listened = true
+		return net.ListenPacket("udp", address)
+	})
+	// transports are registered globally so use a unique name for repeated runs
+	network := fmt.Sprintf("test-transport-%d", time.Now().UnixNano())
+	if err := RegisterTransport(network, transport); err != nil {
+		t.Fatal("Error registering transport:", err)
+	}
+	if err := RegisterTransport(network, transport); err != ErrTransportAlreadyExists {
+		t.Error("Expected transport already exists error, received:", err)
+	}
+	if err := RegisterTransport("udp", transport); err != ErrTransportAlreadyExists {
+		t.Error("Expected transport already exists error, received:", err)
+	}
+	if err := RegisterTransport("nil-transport", nil); err != ErrNilTransport {
+		t.Error("Expected nil transport error, received:", err)
+	}
+	server, _, err := New(network, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating server with custom transport:", err)
+	}
+	defer server.Shutdown(context.Background())
+	if !listened {
+		t.Error("Expected custom transport to be used")
+	}
+}
+
+func TestNewFromConnNil(t *testing.T) {
+	if _, _, err := NewFromConn(nil); err != ErrMissingPacketConn {
+		t.Fatal("Expected missing packet conn error, received:", err)
+	}
+}
+
+func TestNewFromConnMock(t *testing.T) {
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	serverConn := mocks.NewMockPacketConn(serverReader, serverWriter)
+	clientConn := mocks.NewMockPacketConn(clientReader, clientWriter)
+
+	server, _, err := NewFromConn(serverConn, WithConcurrencyLimit(2), WithReadBufferSize(1024))
+	if err != nil {
+		t.Fatal("Error creating server from mock conn:", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	received := make(chan string, 1)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		received <- string(packet.Msg())
+	})
+	go server.Serve(mux)
+
+	msg, _ := NewPacketMessageBuilder([]byte("mock")).WithPacketType(PacketType(1)).Build()
+	go clientConn.WriteTo(msg, nil)
+	select {
+	case body := <-received:
+		if body != "mock" {
+			t.Error("Unexpected message:", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for mock packet")
+	}
+}
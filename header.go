@@ -0,0 +1,140 @@
+package hacket
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Messages start with either the legacy header, a single byte holding a
+// PacketType up to 255 other than headerEscape, or with headerEscape. The byte
+// after headerEscape identifies either the version of the header that follows
+// or one of hacket's internal frames, see frameType.
+//
+// Version 1 is laid out as
+//
+//	| 0xF8 | 0x01 | PacketType (uint16 big endian) | flags (uint8) | message | trailer |
+//
+// The trailer is only present when a flag that requires it is set.
+const (
+	// headerEscape is the first byte of every message that does not use the
+	// legacy header. PacketType 0xF8 is therefore always sent with a versioned header
+	headerEscape byte = 0xF8
+	// headerV1 identifies a version 1 header
+	headerV1 byte = 0x01
+	// headerV1Size is the size of a version 1 header
+	headerV1Size = 1 + 1 + 2 + 1
+)
+
+// headerFlags are the flags of a versioned header
+type headerFlags uint8
+
+const (
+	// flagChecksum marks a message followed by a CRC32C trailer covering the
+	// header and message
+	flagChecksum headerFlags = 1 << 0
+
+	// knownHeaderFlags are the flags this version of hacket understands. Messages
+	// with any other flag set are rejected since the flag may change how the
+	// message has to be read
+	knownHeaderFlags = flagChecksum
+)
+
+// checksumSize is the size of the CRC32C trailer
+const checksumSize = 4
+
+// castagnoli is the CRC32C table, which is hardware accelerated on most platforms
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// header is the decoded header of a message
+type header struct {
+	pktType   PacketType
+	flags     headerFlags
+	versioned bool
+	// size is the number of bytes taken by the header
+	size int
+}
+
+// fitsLegacyHeader reports whether pktType can be sent with the one byte legacy header
+func (t PacketType) fitsLegacyHeader() bool {
+	return t <= 0xFF && t != PacketType(headerEscape)
+}
+
+// decodeHeader decodes the header at the start of b
+func decodeHeader(b []byte) (header, error) {
+	if len(b) < 1 {
+		return header{}, ErrShortPacket
+	}
+	if b[0] != headerEscape {
+		return header{pktType: PacketType(b[0]), size: 1}, nil
+	}
+	if len(b) < 2 {
+		return header{}, ErrShortPacket
+	}
+	if b[1] != headerV1 {
+		return header{}, ErrUnsupportedHeaderVersion
+	}
+	if len(b) < headerV1Size {
+		return header{}, ErrShortPacket
+	}
+	h := header{
+		pktType:   PacketType(binary.BigEndian.Uint16(b[2:4])),
+		flags:     headerFlags(b[4]),
+		versioned: true,
+		size:      headerV1Size,
+	}
+	if h.flags&^knownHeaderFlags != 0 {
+		return header{}, ErrUnsupportedHeaderFlags
+	}
+	return h, nil
+}
+
+// decodeMessage decodes the header at the start of b and returns the message
+// that follows it. A checksum trailer is verified and removed
+func decodeMessage(b []byte) (header, PacketMessage, error) {
+	h, err := decodeHeader(b)
+	if err != nil {
+		return header{}, nil, err
+	}
+	end := len(b)
+	if h.flags&flagChecksum != 0 {
+		end -= checksumSize
+		if end < h.size {
+			return header{}, nil, ErrShortPacket
+		}
+		if crc32.Checksum(b[:end], castagnoli) != binary.BigEndian.Uint32(b[end:]) {
+			return header{}, nil, ErrChecksumMismatch
+		}
+	}
+	return h, b[h.size:end], nil
+}
+
+// appendChecksum appends the CRC32C of b to b
+func appendChecksum(b []byte) []byte {
+	var sum [checksumSize]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, castagnoli))
+	return append(b, sum[:]...)
+}
+
+// encodedSize returns the size of a message of n bytes once the header for
+// pktType and any trailer required by flags are added
+func encodedSize(pktType PacketType, n int, flags headerFlags, versioned bool) int {
+	size := 1 + n
+	if versioned || flags != 0 || !pktType.fitsLegacyHeader() {
+		size = headerV1Size + n
+	}
+	if flags&flagChecksum != 0 {
+		size += checksumSize
+	}
+	return size
+}
+
+// appendHeader appends the header for pktType to b. The legacy header is used
+// when pktType fits in it and versioned is false
+func appendHeader(b []byte, pktType PacketType, flags headerFlags, versioned bool) []byte {
+	if !versioned && flags == 0 && pktType.fitsLegacyHeader() {
+		return append(b, uint8(pktType))
+	}
+	var typeBytes [2]byte
+	binary.BigEndian.PutUint16(typeBytes[:], uint16(pktType))
+	return append(b, headerEscape, headerV1, typeBytes[0], typeBytes[1], uint8(flags))
+}
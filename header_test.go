@@ -0,0 +1,176 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeaderEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		pktType   PacketType
+		versioned bool
+		want      []byte
+	}{
+		{"legacy", 7, false, []byte{7, 'm'}},
+		{"legacy high", 0xF0, false, []byte{0xF0, 'm'}},
+		{"forced versioned", 7, true, []byte{headerEscape, headerV1, 0, 7, 0, 'm'}},
+		{"wide", 0x1234, false, []byte{headerEscape, headerV1, 0x12, 0x34, 0, 'm'}},
+		{"escape byte", 0xF8, false, []byte{headerEscape, headerV1, 0, 0xF8, 0, 'm'}},
+		{"error", PacketTypeError, false, []byte{headerEscape, headerV1, 0xFF, 0xFF, 0, 'm'}},
+	}
+	for _, tt := range tests {
+		builder := NewPacketMessageBuilder([]byte("m")).WithPacketType(tt.pktType)
+		if tt.versioned {
+			builder.WithVersionedHeader()
+		}
+		msg, err := builder.Build()
+		if err != nil {
+			t.Fatal(tt.name, "error building:", err)
+		}
+		if !bytes.Equal(msg, tt.want) {
+			t.Errorf("%s expected %v got %v", tt.name, tt.want, msg)
+		}
+		pktType, body, err := decode(msg)
+		if err != nil || pktType != tt.pktType || string(body) != "m" {
+			t.Errorf("%s expected %d m got %d %s %v", tt.name, tt.pktType, pktType, body, err)
+		}
+	}
+}
+
+func TestHeaderDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{
+		{"empty", []byte{}, ErrShortPacket},
+		{"short escape", []byte{headerEscape}, ErrShortPacket},
+		{"short versioned", []byte{headerEscape, headerV1, 0}, ErrShortPacket},
+		{"future version", []byte{headerEscape, headerV1 + 1, 0, 1, 0}, ErrUnsupportedHeaderVersion},
+		{"unknown flags", []byte{headerEscape, headerV1, 0, 1, 0x80}, ErrUnsupportedHeaderFlags},
+	}
+	for _, tt := range tests {
+		if _, _, err := decode(tt.msg); err != tt.err {
+			t.Errorf("%s expected %v got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestPacketMuxHeaders(t *testing.T) {
+	mux := NewPacketMux()
+	var got []string
+	for _, pktType := range []PacketType{1, 0x1234} {
+		pktType := pktType
+		if err := mux.PacketHandlerFunc(pktType, func(packet Packet, pw PacketWriter) {
+			got = append(got, pktType.String()+":"+string(packet.Msg()))
+		}); err != nil {
+			t.Fatal("Error registering handler:", err)
+		}
+	}
+	legacy, _ := NewPacketMessageBuilder([]byte("a")).WithPacketType(1).Build()
+	versioned, _ := NewPacketMessageBuilder([]byte("b")).WithPacketType(1).WithVersionedHeader().Build()
+	wide, _ := NewPacketMessageBuilder([]byte("c")).WithPacketType(0x1234).Build()
+	for _, msg := range []PacketMessage{legacy, versioned, wide} {
+		mux.HandlePacket(NewPacket(msg, nil, time.Now()), &recordingPacketWriter{})
+	}
+	want := []string{"PacketType(1):a", "PacketType(1):b", "PacketType(4660):c"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v got %v", want, got)
+		}
+	}
+}
+
+func TestWideErrorPacket(t *testing.T) {
+	for _, pktType := range []PacketType{3, 0x1234} {
+		msg, err := NewErrorPacketMessage(ErrorCodeUnknownPacketType, pktType, "detail")
+		if err != nil {
+			t.Fatal("Error building error packet:", err)
+		}
+		if !IsErrorPacket(msg) {
+			t.Fatal("Expected error packet")
+		}
+		pe, err := ParseErrorPacket(msg)
+		if err != nil || pe.PacketType != pktType || pe.Code != ErrorCodeUnknownPacketType || pe.Message != "detail" {
+			t.Errorf("Expected %d got %+v %v", pktType, pe, err)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	msg, err := NewPacketMessageBuilder([]byte("body")).WithPacketType(1).WithChecksum().Build()
+	if err != nil {
+		t.Fatal("Error building:", err)
+	}
+	if len(msg) != headerV1Size+len("body")+checksumSize || headerFlags(msg[4])&flagChecksum == 0 {
+		t.Fatalf("Expected checksummed versioned message got %v", msg)
+	}
+	pktType, body, err := decode(msg)
+	if err != nil || pktType != 1 || string(body) != "body" {
+		t.Errorf("Expected 1 body got %d %s %v", pktType, body, err)
+	}
+	corrupted := append(PacketMessage(nil), msg...)
+	corrupted[headerV1Size] ^= 0x01
+	if _, _, err := decode(corrupted); err != ErrChecksumMismatch {
+		t.Error("Expected ErrChecksumMismatch got", err)
+	}
+	if _, _, err := decode(msg[:headerV1Size+2]); err != ErrShortPacket {
+		t.Error("Expected ErrShortPacket got", err)
+	}
+}
+
+func TestPacketMuxChecksum(t *testing.T) {
+	dropped := make(chan error, 4)
+	server, client, err := New("udp", "127.0.0.1:0", WithDropHandler(func(packet Packet, reason DropReason) {
+		if reason == DropReasonChecksum {
+			dropped <- nil
+		}
+	}))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	handled := make(chan string, 4)
+	mux := NewPacketMux()
+	mux.RequireChecksum(2)
+	for _, pktType := range []PacketType{1, 2} {
+		mux.PacketHandlerFunc(pktType, func(packet Packet, pw PacketWriter) {
+			handled <- string(packet.Msg())
+		})
+	}
+	go server.Serve(mux)
+
+	legacy, _ := NewPacketMessageBuilder([]byte("legacy")).WithPacketType(1).Build()
+	checked, _ := NewPacketMessageBuilder([]byte("checked")).WithPacketType(2).WithChecksum().Build()
+	missing, _ := NewPacketMessageBuilder([]byte("missing")).WithPacketType(2).Build()
+	corrupted, _ := NewPacketMessageBuilder([]byte("corrupted")).WithPacketType(1).WithChecksum().Build()
+	corrupted[headerV1Size] ^= 0x01
+	for _, msg := range []PacketMessage{legacy, checked, missing, corrupted} {
+		client.WriteTo(msg, server.Addr())
+	}
+
+	got := map[string]bool{}
+	drops := 0
+	for len(got)+drops < 4 {
+		select {
+		case msg := <-handled:
+			got[msg] = true
+		case <-dropped:
+			drops++
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out with %v handled and %d dropped", got, drops)
+		}
+	}
+	if !got["legacy"] || !got["checked"] || drops != 2 {
+		t.Errorf("Expected legacy and checked handled and 2 drops got %v and %d", got, drops)
+	}
+	if stats := server.Stats(); stats.Dropped[DropReasonChecksum] != 2 {
+		t.Error("Expected 2 checksum drops counted got", stats.Dropped[DropReasonChecksum])
+	}
+}
@@ -0,0 +1,30 @@
+package mocks
+
+import (
+	"net"
+)
+
+// LossyPacketConn wraps a net.PacketConn and silently discards
+// written packets when drop returns true. It is used to test
+// behaviour over an unreliable network
+type LossyPacketConn struct {
+	net.PacketConn
+	drop func(b []byte, addr net.Addr) bool
+}
+
+// NewLossyPacketConn creates a lossy packet connection around conn
+func NewLossyPacketConn(conn net.PacketConn, drop func(b []byte, addr net.Addr) bool) *LossyPacketConn {
+	return &LossyPacketConn{
+		PacketConn: conn,
+		drop:       drop,
+	}
+}
+
+// WriteTo writes b to addr unless the packet is dropped. Dropped
+// packets report a successful write
+func (l *LossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.drop(b, addr) {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,928 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Noise frames start with the frame header followed by a kind byte
+//
+//	init      | 0xF8 | 0xF7 | 1 | pattern | sender index (uint32) | cookie (16) | handshake message |
+//	response  | 0xF8 | 0xF7 | 2 | sender index (uint32) | receiver index (uint32) | handshake message |
+//	final     | 0xF8 | 0xF7 | 3 | receiver index (uint32) | handshake message |
+//	transport | 0xF8 | 0xF7 | 4 | receiver index (uint32) | counter (uint64) | ciphertext |
+//	cookie    | 0xF8 | 0xF7 | 5 | receiver index (uint32) | cookie (16) |
+//
+// Indexes are chosen by each peer to identify its side of a session, so a
+// receiver finds the session for a message without relying on the address it
+// came from. The transport counter is the nonce of the cipher and is checked
+// against a sliding window so messages may arrive out of order but only once.
+//
+// A transport message with an empty ciphertext confirms a session. The IK
+// initiator sends one as soon as the handshake completes and the NoiseXX
+// responder sends one when it receives the final message.
+//
+// While a responder is under load it answers init messages without a valid
+// cookie with a cookie message instead of performing any Diffie-Hellman
+// operations. The cookie is a MAC of the initiator's address, so only a peer
+// that receives datagrams at that address can complete a handshake.
+const (
+	noiseInit uint8 = iota + 1
+	noiseResponse
+	noiseFinal
+	noiseTransport
+	noiseCookie
+)
+
+const (
+	noiseInitHeaderSize      = frameHeaderSize + 1 + 1 + 4 + noiseCookieSize
+	noiseResponseHeaderSize  = frameHeaderSize + 1 + 4 + 4
+	noiseFinalHeaderSize     = frameHeaderSize + 1 + 4
+	noiseTransportHeaderSize = frameHeaderSize + 1 + 4 + 8
+	noiseCookieReplySize     = frameHeaderSize + 1 + 4 + noiseCookieSize
+	// noiseCookieSize is the size of a cookie
+	noiseCookieSize = 16
+	// noiseCookieLifetime is how often the secret cookies are derived from is replaced
+	noiseCookieLifetime = 2 * time.Minute
+	// noiseLoadThreshold is the number of init messages a responder processes
+	// each second before it requires cookies
+	noiseLoadThreshold = 128
+	// noiseTimestampSize is the size of the timestamp sent in the IK init message
+	noiseTimestampSize = 8
+	// noiseTagSize is the size of the authentication tag of every Noise cipher
+	noiseTagSize = 16
+	// noiseSealOverhead is the size a Noise session adds to a message
+	noiseSealOverhead = noiseTransportHeaderSize + noiseTagSize
+	// maxNoiseSessions bounds the number of established sessions
+	maxNoiseSessions = 4096
+	// maxNoiseHandshakes bounds the number of handshakes in progress
+	maxNoiseHandshakes = 1024
+)
+
+// noisePrologue binds handshakes to this protocol
+var noisePrologue = []byte("hacket noise v1")
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// NoisePattern is the Noise handshake pattern used when initiating a session
+type NoisePattern uint8
+
+const (
+	// NoiseIK authenticates both peers in a single round trip. The initiator
+	// must know the responder's static public key in advance
+	NoiseIK NoisePattern = iota
+	// NoiseXX exchanges static public keys during the handshake, which takes
+	// one and a half round trips. Neither peer needs to know the other's key
+	NoiseXX
+)
+
+func (p NoisePattern) handshakePattern() (noise.HandshakePattern, bool) {
+	switch p {
+	case NoiseIK:
+		return noise.HandshakeIK, true
+	case NoiseXX:
+		return noise.HandshakeXX, true
+	default:
+		return noise.HandshakePattern{}, false
+	}
+}
+
+// NoiseKeypair is a Curve25519 static keypair identifying a peer
+type NoiseKeypair struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateNoiseKeypair creates a new static keypair
+func GenerateNoiseKeypair() (NoiseKeypair, error) {
+	key, err := noiseCipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return NoiseKeypair{}, err
+	}
+	return NoiseKeypair{Private: key.Private, Public: key.Public}, nil
+}
+
+// NoiseConfig configures Noise handshakes and sessions, see WithNoise
+type NoiseConfig struct {
+	// StaticKeypair identifies this peer
+	StaticKeypair NoiseKeypair
+	// Pattern is used by PacketClient.Handshake. Responders accept either pattern
+	Pattern NoisePattern
+	// Authorize is called with the static public key of the remote peer once it
+	// is known. Returning false aborts the handshake. When nil every peer is accepted
+	Authorize func(peerStaticKey []byte) bool
+	// AllowPlaintext accepts datagrams from peers without a session. By default
+	// they are dropped with DropReasonUnauthenticated unless a Keyring opens them
+	AllowPlaintext bool
+	// HandshakeTimeout is how long a handshake may take before it is abandoned.
+	// Five seconds is used when zero
+	HandshakeTimeout time.Duration
+}
+
+// noiseSession is an established session with a peer
+type noiseSession struct {
+	localIndex  uint32
+	remoteIndex uint32
+	addr        net.Addr
+	peerKey     []byte
+	initiator   bool
+	send        noise.Cipher
+	recv        noise.Cipher
+	counter     uint64
+	// response is resent when a retransmitted init is received
+	response []byte
+	// final is the NoiseXX final message, a retransmission is answered with
+	// another confirmation
+	final []byte
+	// previous is the session with the same address this session replaced. It
+	// is still read from until this session is confirmed
+	previous *noiseSession
+	// done is signalled when the session is confirmed for a NoiseXX initiator
+	// waiting in Handshake
+	done chan error
+
+	mu        sync.Mutex
+	window    slidingWindow
+	lastSeen  time.Time
+	confirmed bool
+}
+
+// noiseHandshake is a handshake in progress
+type noiseHandshake struct {
+	hs         *noise.HandshakeState
+	localIndex uint32
+	// remoteIndex is only known to the responder until the response is read
+	remoteIndex uint32
+	addr        net.Addr
+	initiator   bool
+	// peerKey is the static key the initiator expects the responder to have
+	peerKey  []byte
+	response []byte
+	started  time.Time
+	// frame is the message the initiator retransmits until the handshake completes
+	frame []byte
+	// session is the NoiseXX initiator's session waiting to be confirmed
+	session *noiseSession
+	done    chan error
+	// resend asks the initiator to retransmit frame immediately
+	resend chan struct{}
+}
+
+// noiseState holds the handshakes and sessions of an endpoint
+type noiseState struct {
+	config NoiseConfig
+	// loadThreshold is the number of init messages processed each second
+	// before cookies are required
+	loadThreshold int
+
+	mu         sync.Mutex
+	handshakes map[uint32]*noiseHandshake
+	// responding holds the handshake each address is completing with this responder
+	responding map[string]*noiseHandshake
+	sessions   map[uint32]*noiseSession
+	byAddr     map[string]*noiseSession
+	// pending holds the session each address established with this responder
+	// that has not been confirmed yet
+	pending map[string]*noiseSession
+
+	// timestamps holds the newest IK init timestamp accepted from each static
+	// key. Init messages with a timestamp below timestampFloor are rejected for
+	// keys that are no longer tracked
+	timestamps     map[string]uint64
+	timestampFloor uint64
+	lastTimestamp  uint64
+
+	cookieSecrets [2][32]byte
+	cookieRotated time.Time
+	loadStart     time.Time
+	loadCount     int
+}
+
+func newNoiseState(config NoiseConfig) (*noiseState, error) {
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = 5 * time.Second
+	}
+	ns := &noiseState{
+		config:        config,
+		loadThreshold: noiseLoadThreshold,
+		handshakes:    make(map[uint32]*noiseHandshake),
+		responding:    make(map[string]*noiseHandshake),
+		sessions:      make(map[uint32]*noiseSession),
+		byAddr:        make(map[string]*noiseSession),
+		pending:       make(map[string]*noiseSession),
+		timestamps:    make(map[string]uint64),
+		cookieRotated: time.Now(),
+	}
+	for i := range ns.cookieSecrets {
+		if _, err := rand.Read(ns.cookieSecrets[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// newIndex returns an index that is not used by a session or handshake. It
+// must be called with mu held
+func (ns *noiseState) newIndex() (uint32, error) {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		index := binary.BigEndian.Uint32(b[:])
+		if _, ok := ns.sessions[index]; ok {
+			continue
+		}
+		if _, ok := ns.handshakes[index]; ok || index == 0 {
+			continue
+		}
+		return index, nil
+	}
+}
+
+// newHandshakeState creates the Noise handshake state for pattern
+func (ns *noiseState) newHandshakeState(pattern NoisePattern, initiator bool, peerKey []byte) (*noise.HandshakeState, error) {
+	hp, ok := pattern.handshakePattern()
+	if !ok {
+		return nil, ErrUnknownNoisePattern
+	}
+	return noise.NewHandshakeState(noise.Config{
+		CipherSuite: noiseCipherSuite,
+		Random:      rand.Reader,
+		Pattern:     hp,
+		Initiator:   initiator,
+		Prologue:    noisePrologue,
+		StaticKeypair: noise.DHKey{
+			Private: ns.config.StaticKeypair.Private,
+			Public:  ns.config.StaticKeypair.Public,
+		},
+		PeerStatic: peerKey,
+	})
+}
+
+// authorize reports whether the peer with peerKey may establish a session
+func (ns *noiseState) authorize(peerKey []byte) bool {
+	return ns.config.Authorize == nil || ns.config.Authorize(peerKey)
+}
+
+// session returns the session established with addr
+func (ns *noiseState) session(addr net.Addr) *noiseSession {
+	if addr == nil {
+		return nil
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.byAddr[addr.String()]
+}
+
+// newSession records a completed handshake as a session that can be read
+// from. It must be called with mu held
+func (ns *noiseState) newSession(h *noiseHandshake, send, recv *noise.CipherState) *noiseSession {
+	delete(ns.handshakes, h.localIndex)
+	if ns.responding[h.addr.String()] == h {
+		delete(ns.responding, h.addr.String())
+	}
+	s := &noiseSession{
+		localIndex:  h.localIndex,
+		remoteIndex: h.remoteIndex,
+		addr:        h.addr,
+		peerKey:     h.hs.PeerStatic(),
+		initiator:   h.initiator,
+		send:        send.Cipher(),
+		recv:        recv.Cipher(),
+		response:    h.response,
+		lastSeen:    time.Now(),
+	}
+	if len(ns.sessions) >= maxNoiseSessions {
+		ns.evictSession()
+	}
+	ns.sessions[s.localIndex] = s
+	return s
+}
+
+// activate makes s the session written to its address. The session it
+// replaces is still read from until s is confirmed. It must be called with mu held
+func (ns *noiseState) activate(s *noiseSession) {
+	key := s.addr.String()
+	if old, ok := ns.byAddr[key]; ok && old != s {
+		ns.forget(old.previous)
+		old.previous = nil
+		s.previous = old
+	}
+	ns.byAddr[key] = s
+}
+
+// hold keeps a session established by a responder pending until the
+// initiator proves it holds the session keys, so a replayed init message can
+// not replace an established session. Each address has at most one pending
+// session. It must be called with mu held
+func (ns *noiseState) hold(s *noiseSession) {
+	key := s.addr.String()
+	if old, ok := ns.pending[key]; ok && old != s {
+		ns.forget(old)
+	}
+	ns.pending[key] = s
+}
+
+// confirm is called once s has received an authenticated transport message,
+// which proves the peer holds the session keys. A pending session becomes the
+// session written to its address and the session it replaced is forgotten.
+// It must be called with mu held
+func (ns *noiseState) confirm(s *noiseSession) {
+	if ns.sessions[s.localIndex] != s {
+		// replaced or evicted while the message was decrypted
+		return
+	}
+	key := s.addr.String()
+	if ns.pending[key] == s {
+		delete(ns.pending, key)
+		ns.activate(s)
+	}
+	ns.forget(s.previous)
+	s.previous = nil
+	if s.done != nil {
+		select {
+		case s.done <- nil:
+		default:
+		}
+		s.done = nil
+	}
+}
+
+// forget removes s so it can no longer be read from. It must be called with mu held
+func (ns *noiseState) forget(s *noiseSession) {
+	if s == nil || ns.sessions[s.localIndex] != s {
+		return
+	}
+	delete(ns.sessions, s.localIndex)
+	key := s.addr.String()
+	if ns.byAddr[key] == s {
+		delete(ns.byAddr, key)
+		if s.previous != nil && ns.sessions[s.previous.localIndex] == s.previous {
+			// fall back to the session s replaced
+			ns.byAddr[key] = s.previous
+		}
+	}
+	if ns.pending[key] == s {
+		delete(ns.pending, key)
+	}
+}
+
+// evictSession removes the least recently seen session. It must be called with mu held
+func (ns *noiseState) evictSession() {
+	var oldest *noiseSession
+	for _, s := range ns.sessions {
+		s.mu.Lock()
+		if oldest == nil || s.lastSeen.Before(oldest.lastSeen) {
+			oldest = s
+		}
+		s.mu.Unlock()
+	}
+	if oldest != nil {
+		oldest.previous = nil
+		ns.forget(oldest)
+	}
+}
+
+// pruneHandshakes abandons handshakes older than the handshake timeout. It
+// must be called with mu held
+func (ns *noiseState) pruneHandshakes(now time.Time) {
+	for index, h := range ns.handshakes {
+		if now.Sub(h.started) > ns.config.HandshakeTimeout {
+			delete(ns.handshakes, index)
+			if ns.responding[h.addr.String()] == h {
+				delete(ns.responding, h.addr.String())
+			}
+		}
+	}
+}
+
+// nextTimestamp returns the timestamp sent in an IK init message at now. Each
+// timestamp is larger than the last. It must be called with mu held
+func (ns *noiseState) nextTimestamp(now time.Time) uint64 {
+	ts := uint64(now.UnixNano())
+	if ts <= ns.lastTimestamp {
+		ts = ns.lastTimestamp + 1
+	}
+	ns.lastTimestamp = ts
+	return ts
+}
+
+// checkTimestamp rejects an IK init message whose timestamp is not newer than
+// the last one accepted from peerKey, as WireGuard does, so recorded init
+// messages can not be replayed. It must be called with mu held
+func (ns *noiseState) checkTimestamp(peerKey []byte, payload []byte) error {
+	if len(payload) < noiseTimestampSize {
+		return ErrShortPacket
+	}
+	ts := binary.BigEndian.Uint64(payload)
+	key := string(peerKey)
+	last, ok := ns.timestamps[key]
+	if !ok {
+		last = ns.timestampFloor
+	}
+	if ts <= last {
+		return ErrReplayedHandshake
+	}
+	if !ok && len(ns.timestamps) >= maxNoiseSessions {
+		ns.evictTimestamp()
+	}
+	ns.timestamps[key] = ts
+	return nil
+}
+
+// evictTimestamp stops tracking the static key with the oldest timestamp and
+// raises the floor so its init messages still can not be replayed. It must be
+// called with mu held
+func (ns *noiseState) evictTimestamp() {
+	var oldestKey string
+	var oldest uint64
+	for key, ts := range ns.timestamps {
+		if oldestKey == "" || ts < oldest {
+			oldestKey, oldest = key, ts
+		}
+	}
+	delete(ns.timestamps, oldestKey)
+	if oldest > ns.timestampFloor {
+		ns.timestampFloor = oldest
+	}
+}
+
+// underLoad reports whether enough init messages have been processed within
+// the last second that cookies are required. It must be called with mu held
+func (ns *noiseState) underLoad(now time.Time) bool {
+	if now.Sub(ns.loadStart) >= time.Second {
+		ns.loadStart = now
+		ns.loadCount = 0
+	}
+	return ns.loadCount >= ns.loadThreshold
+}
+
+// cookie returns the cookie for addr derived from the secret at index. It
+// must be called with mu held
+func (ns *noiseState) cookie(index int, addr string, now time.Time) []byte {
+	if now.Sub(ns.cookieRotated) >= noiseCookieLifetime {
+		var secret [32]byte
+		// keep the current secret until a new one can be read
+		if _, err := rand.Read(secret[:]); err == nil {
+			ns.cookieSecrets[1] = ns.cookieSecrets[0]
+			ns.cookieSecrets[0] = secret
+			ns.cookieRotated = now
+		}
+	}
+	mac := hmac.New(sha256.New, ns.cookieSecrets[index][:])
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)[:noiseCookieSize]
+}
+
+// validCookie reports whether cookie was issued to addr with the current or
+// previous secret. It must be called with mu held
+func (ns *noiseState) validCookie(cookie []byte, addr string, now time.Time) bool {
+	return hmac.Equal(cookie, ns.cookie(0, addr, now)) || hmac.Equal(cookie, ns.cookie(1, addr, now))
+}
+
+// seal encrypts b for the session's peer
+func (s *noiseSession) seal(b []byte) ([]byte, error) {
+	counter := atomic.AddUint64(&s.counter, 1)
+	if counter > noise.MaxNonce {
+		return nil, noise.ErrMaxNonce
+	}
+	frame := make([]byte, noiseTransportHeaderSize, noiseTransportHeaderSize+len(b)+noiseTagSize)
+	putFrameHeader(frame, frameNoise)
+	frame[2] = noiseTransport
+	binary.BigEndian.PutUint32(frame[3:7], s.remoteIndex)
+	binary.BigEndian.PutUint64(frame[7:noiseTransportHeaderSize], counter)
+	return s.send.Encrypt(frame, counter, frame[:noiseTransportHeaderSize], b), nil
+}
+
+// initiate starts a handshake with addr and returns it with the init message
+// in its frame. peerKey is the static key the responder must have
+func (ns *noiseState) initiate(pattern NoisePattern, addr net.Addr, peerKey []byte, now time.Time) (*noiseHandshake, error) {
+	var expected []byte
+	if pattern == NoiseXX {
+		// the peer's key is learnt during the handshake and compared afterwards
+		if len(peerKey) > 0 {
+			expected = append([]byte(nil), peerKey...)
+		}
+		peerKey = nil
+	}
+	hs, err := ns.newHandshakeState(pattern, true, peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.pruneHandshakes(now)
+	if len(ns.handshakes) >= maxNoiseHandshakes {
+		return nil, ErrTooManyHandshakes
+	}
+	localIndex, err := ns.newIndex()
+	if err != nil {
+		return nil, err
+	}
+	h := &noiseHandshake{
+		hs:         hs,
+		localIndex: localIndex,
+		addr:       addr,
+		initiator:  true,
+		peerKey:    expected,
+		started:    now,
+		done:       make(chan error, 1),
+		resend:     make(chan struct{}, 1),
+	}
+	var payload []byte
+	if pattern == NoiseIK {
+		// the timestamp is encrypted for the responder, which rejects init
+		// messages that are not newer than the last one from this peer
+		payload = make([]byte, noiseTimestampSize)
+		binary.BigEndian.PutUint64(payload, ns.nextTimestamp(now))
+	}
+	frame := make([]byte, noiseInitHeaderSize, 256)
+	putFrameHeader(frame, frameNoise)
+	frame[2] = noiseInit
+	frame[3] = uint8(pattern)
+	binary.BigEndian.PutUint32(frame[4:8], h.localIndex)
+	frame, _, _, err = hs.WriteMessage(frame, payload)
+	if err != nil {
+		return nil, err
+	}
+	h.frame = frame
+	ns.handshakes[h.localIndex] = h
+	return h, nil
+}
+
+// handshake performs a Noise handshake with addr and waits for the session to
+// be established. peerKey is the static public key expected for addr. It is
+// required for NoiseIK and checked once the handshake completes for NoiseXX
+func (ep *endpoint) handshake(ctx context.Context, addr net.Addr, peerKey []byte) (err error) {
+	ns := ep.noise
+	if ns == nil {
+		return ErrNoiseDisabled
+	}
+	if ns.config.Pattern == NoiseIK && len(peerKey) == 0 {
+		return ErrPeerStaticKeyRequired
+	}
+	h, err := ns.initiate(ns.config.Pattern, addr, peerKey, time.Now())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ns.mu.Lock()
+		if ns.handshakes[h.localIndex] == h {
+			delete(ns.handshakes, h.localIndex)
+		}
+		if err != nil && h.session != nil {
+			// the responder never confirmed the NoiseXX session
+			ns.forget(h.session)
+		}
+		ns.mu.Unlock()
+	}()
+
+	timeout := ep.options.RetransmitTimeout
+	deadline := time.NewTimer(ns.config.HandshakeTimeout)
+	defer deadline.Stop()
+	for {
+		ns.mu.Lock()
+		frame := h.frame
+		ns.mu.Unlock()
+		if _, err := ep.writeRaw(frame, addr); err != nil {
+			return err
+		}
+		retransmit := time.NewTimer(timeout)
+		select {
+		case err := <-h.done:
+			retransmit.Stop()
+			return err
+		case <-ctx.Done():
+			retransmit.Stop()
+			return ctx.Err()
+		case <-deadline.C:
+			retransmit.Stop()
+			return ErrHandshakeTimeout
+		case <-h.resend:
+			retransmit.Stop()
+			continue
+		case <-retransmit.C:
+		}
+		timeout *= 2
+		if ep.options.MaxRetransmitTimeout > 0 && timeout > ep.options.MaxRetransmitTimeout {
+			timeout = ep.options.MaxRetransmitTimeout
+		}
+	}
+}
+
+// receiveNoise processes a Noise frame. Transport messages are decrypted in
+// place and returned, handshake messages are consumed
+func (ep *endpoint) receiveNoise(packet Packet) (Packet, bool) {
+	msg := packet.Msg()
+	ns := ep.noise
+	addr := packet.FromAddr()
+	var reply []byte
+	var err error
+	switch {
+	case len(msg) < frameHeaderSize+1:
+		err = ErrShortPacket
+	case msg[2] == noiseTransport:
+		return ep.receiveNoiseTransport(packet)
+	case addr == nil:
+		err = ErrMissingAddr
+	case msg[2] == noiseInit:
+		reply, err = ns.acceptInit(msg, addr, packet.Timestamp())
+	case msg[2] == noiseResponse:
+		reply, err = ns.acceptResponse(msg)
+	case msg[2] == noiseFinal:
+		reply, err = ns.acceptFinal(msg)
+	case msg[2] == noiseCookie:
+		err = ns.acceptCookie(msg, addr)
+	default:
+		err = ErrUnknownNoiseMessage
+	}
+	// replies are written once the noise state is unlocked
+	if reply != nil {
+		if _, writeErr := ep.writeRaw(reply, addr); err == nil {
+			err = writeErr
+		}
+	}
+	if err != nil {
+		ep.mon.logger.Log(LevelDebug, "noise handshake failed", "from", addr, "err", err)
+		reason := DropReasonUnauthenticated
+		if err == ErrReplayedHandshake {
+			reason = DropReasonReplay
+		}
+		ep.mon.drops.drop(packet, reason)
+	}
+	return packet, false
+}
+
+// receiveNoiseTransport decrypts a transport message
+func (ep *endpoint) receiveNoiseTransport(packet Packet) (Packet, bool) {
+	msg := packet.Msg()
+	reject := func(reason DropReason, err error) (Packet, bool) {
+		ep.mon.logger.Log(LevelDebug, "noise transport message rejected", "from", packet.FromAddr(), "err", err)
+		ep.mon.drops.drop(packet, reason)
+		return packet, false
+	}
+	if len(msg) < noiseTransportHeaderSize {
+		return reject(DropReasonMalformed, ErrShortPacket)
+	}
+	ns := ep.noise
+	ns.mu.Lock()
+	s, ok := ns.sessions[binary.BigEndian.Uint32(msg[3:7])]
+	ns.mu.Unlock()
+	if !ok {
+		return reject(DropReasonUnauthenticated, ErrUnknownNoiseSession)
+	}
+	counter := binary.BigEndian.Uint64(msg[7:noiseTransportHeaderSize])
+	ciphertext := msg[noiseTransportHeaderSize:]
+	plaintext, err := s.recv.Decrypt(ciphertext[:0], counter, msg[:noiseTransportHeaderSize], ciphertext)
+	if err != nil {
+		return reject(DropReasonUnauthenticated, ErrUnauthenticated)
+	}
+	s.mu.Lock()
+	accepted := s.window.check(counter)
+	first := accepted && !s.confirmed
+	if accepted {
+		s.lastSeen = packet.Timestamp()
+		s.confirmed = true
+	}
+	s.mu.Unlock()
+	if !accepted {
+		return reject(DropReasonReplay, ErrReplayedPacket)
+	}
+	if first {
+		ns.mu.Lock()
+		ns.confirm(s)
+		ns.mu.Unlock()
+	}
+	if len(plaintext) == 0 {
+		// a confirmation carries no message
+		return packet, false
+	}
+	packet.peerKey = s.peerKey
+	packet.SetMsg(plaintext)
+	return packet, true
+}
+
+// acceptInit responds to the first message of a handshake from addr and
+// returns the reply to send
+func (ns *noiseState) acceptInit(msg []byte, addr net.Addr, now time.Time) ([]byte, error) {
+	if len(msg) < noiseInitHeaderSize {
+		return nil, ErrShortPacket
+	}
+	pattern := NoisePattern(msg[3])
+	remoteIndex := binary.BigEndian.Uint32(msg[4:8])
+	key := addr.String()
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	// a retransmitted init is answered with the response already sent
+	for _, s := range []*noiseSession{ns.pending[key], ns.byAddr[key]} {
+		if s != nil && !s.initiator && s.remoteIndex == remoteIndex && s.response != nil {
+			return s.response, nil
+		}
+	}
+	if h, ok := ns.responding[key]; ok && h.remoteIndex == remoteIndex {
+		return h.response, nil
+	}
+	if ns.underLoad(now) && !ns.validCookie(msg[8:noiseInitHeaderSize], key, now) {
+		// prove the initiator receives datagrams at addr before doing any work
+		reply := make([]byte, noiseCookieReplySize)
+		putFrameHeader(reply, frameNoise)
+		reply[2] = noiseCookie
+		binary.BigEndian.PutUint32(reply[3:7], remoteIndex)
+		copy(reply[7:], ns.cookie(0, key, now))
+		return reply, nil
+	}
+	ns.loadCount++
+
+	hs, err := ns.newHandshakeState(pattern, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload, _, _, err := hs.ReadMessage(nil, msg[noiseInitHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	if pattern == NoiseIK {
+		if !ns.authorize(hs.PeerStatic()) {
+			return nil, ErrPeerNotAuthorized
+		}
+		if err := ns.checkTimestamp(hs.PeerStatic(), payload); err != nil {
+			return nil, err
+		}
+	}
+	ns.pruneHandshakes(now)
+	if len(ns.handshakes) >= maxNoiseHandshakes {
+		return nil, ErrTooManyHandshakes
+	}
+	localIndex, err := ns.newIndex()
+	if err != nil {
+		return nil, err
+	}
+	h := &noiseHandshake{
+		hs:          hs,
+		localIndex:  localIndex,
+		remoteIndex: remoteIndex,
+		addr:        addr,
+		started:     now,
+	}
+	frame := make([]byte, noiseResponseHeaderSize, 256)
+	putFrameHeader(frame, frameNoise)
+	frame[2] = noiseResponse
+	binary.BigEndian.PutUint32(frame[3:7], h.localIndex)
+	binary.BigEndian.PutUint32(frame[7:noiseResponseHeaderSize], remoteIndex)
+	frame, cs0, cs1, err := hs.WriteMessage(frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	h.response = frame
+	// each address completes one handshake at a time
+	if old, ok := ns.responding[key]; ok {
+		delete(ns.handshakes, old.localIndex)
+		delete(ns.responding, key)
+	}
+	if cs0 != nil {
+		// NoiseIK completes once the response is written, the session is used
+		// once the initiator proves it holds the keys
+		ns.hold(ns.newSession(h, cs1, cs0))
+	} else {
+		ns.handshakes[h.localIndex] = h
+		ns.responding[key] = h
+	}
+	return frame, nil
+}
+
+// acceptResponse completes a handshake started by this peer and returns the
+// message to send in reply
+func (ns *noiseState) acceptResponse(msg []byte) ([]byte, error) {
+	if len(msg) < noiseResponseHeaderSize {
+		return nil, ErrShortPacket
+	}
+	remoteIndex := binary.BigEndian.Uint32(msg[3:7])
+	localIndex := binary.BigEndian.Uint32(msg[7:noiseResponseHeaderSize])
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	h, ok := ns.handshakes[localIndex]
+	if !ok || !h.initiator {
+		// a duplicate response for a completed handshake
+		return nil, nil
+	}
+	fail := func(err error) ([]byte, error) {
+		delete(ns.handshakes, localIndex)
+		h.done <- err
+		return nil, err
+	}
+	_, cs0, cs1, err := h.hs.ReadMessage(nil, msg[noiseResponseHeaderSize:])
+	if err != nil {
+		// leave the handshake in place in case this response was forged
+		return nil, err
+	}
+	h.remoteIndex = remoteIndex
+	peerKey := h.hs.PeerStatic()
+	if h.peerKey != nil && !bytes.Equal(h.peerKey, peerKey) {
+		return fail(ErrPeerStaticKeyMismatch)
+	}
+	if !ns.authorize(peerKey) {
+		return fail(ErrPeerNotAuthorized)
+	}
+	if cs0 == nil {
+		// NoiseXX sends the initiator's static key in a final message, which is
+		// retransmitted until the responder confirms the session
+		frame := make([]byte, noiseFinalHeaderSize, 256)
+		putFrameHeader(frame, frameNoise)
+		frame[2] = noiseFinal
+		binary.BigEndian.PutUint32(frame[3:noiseFinalHeaderSize], remoteIndex)
+		frame, cs0, cs1, err = h.hs.WriteMessage(frame, nil)
+		if err != nil {
+			return fail(err)
+		}
+		s := ns.newSession(h, cs0, cs1)
+		ns.activate(s)
+		s.done = h.done
+		h.session = s
+		h.frame = frame
+		return frame, nil
+	}
+	s := ns.newSession(h, cs0, cs1)
+	ns.activate(s)
+	h.done <- nil
+	// confirm the session so the responder starts using it
+	return s.seal(nil)
+}
+
+// acceptFinal completes a NoiseXX handshake started by the peer and returns
+// the confirmation to send
+func (ns *noiseState) acceptFinal(msg []byte) ([]byte, error) {
+	if len(msg) < noiseFinalHeaderSize {
+		return nil, ErrShortPacket
+	}
+	localIndex := binary.BigEndian.Uint32(msg[3:noiseFinalHeaderSize])
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	h, ok := ns.handshakes[localIndex]
+	if !ok || h.initiator {
+		// the initiator retransmits the final message until it is confirmed
+		if s, ok := ns.sessions[localIndex]; ok && !s.initiator && bytes.Equal(s.final, msg) {
+			return s.seal(nil)
+		}
+		return nil, ErrUnknownNoiseSession
+	}
+	_, cs0, cs1, err := h.hs.ReadMessage(nil, msg[noiseFinalHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	if cs0 == nil {
+		return nil, ErrUnknownNoiseMessage
+	}
+	if !ns.authorize(h.hs.PeerStatic()) {
+		delete(ns.handshakes, localIndex)
+		if ns.responding[h.addr.String()] == h {
+			delete(ns.responding, h.addr.String())
+		}
+		return nil, ErrPeerNotAuthorized
+	}
+	// the final message is bound to this responder's ephemeral key, so it
+	// proves the initiator holds the session keys
+	s := ns.newSession(h, cs1, cs0)
+	s.final = append([]byte(nil), msg...)
+	ns.activate(s)
+	return s.seal(nil)
+}
+
+// acceptCookie records the cookie a responder under load requires and asks
+// the initiator to retransmit its init message with it
+func (ns *noiseState) acceptCookie(msg []byte, addr net.Addr) error {
+	if len(msg) < noiseCookieReplySize {
+		return ErrShortPacket
+	}
+	localIndex := binary.BigEndian.Uint32(msg[3:7])
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	h, ok := ns.handshakes[localIndex]
+	if !ok || !h.initiator || h.addr.String() != addr.String() || h.frame[2] != noiseInit {
+		return ErrUnknownNoiseSession
+	}
+	// the frame may be being written, so the cookie is added to a copy
+	frame := append([]byte(nil), h.frame...)
+	copy(frame[8:noiseInitHeaderSize], msg[7:noiseCookieReplySize])
+	h.frame = frame
+	select {
+	case h.resend <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newNoiseEndpoint(t *testing.T, config NoiseConfig, options ...Options) (PacketServer, PacketClient) {
+	t.Helper()
+	server, client, err := New("udp", "127.0.0.1:0", append(options, WithNoise(config))...)
+	if err != nil {
+		t.Fatal("Error creating noise endpoint:", err)
+	}
+	return server, client
+}
+
+func newTestNoiseEndpoint(t *testing.T, config NoiseConfig) *endpoint {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	options, err := newPacketOptions([]Options{WithNoise(config)})
+	if err != nil {
+		t.Fatal("Error applying options:", err)
+	}
+	ep, err := newEndpoint(conn, options)
+	if err != nil {
+		t.Fatal("Error creating endpoint:", err)
+	}
+	return ep
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	for _, pattern := range []NoisePattern{NoiseIK, NoiseXX} {
+		serverKey, _ := GenerateNoiseKeypair()
+		callerKey, _ := GenerateNoiseKeypair()
+
+		server, _ := newNoiseEndpoint(t, NoiseConfig{StaticKeypair: serverKey})
+		defer server.Shutdown(context.Background())
+		peerKeys := make(chan []byte, 1)
+		mux := NewPacketMux()
+		mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+			peerKeys <- append([]byte(nil), packet.PeerStaticKey()...)
+			pw.WriteTo(packet.Msg(), packet.FromAddr())
+		})
+		go server.Serve(mux)
+
+		caller, client := newNoiseEndpoint(t, NoiseConfig{StaticKeypair: callerKey, Pattern: pattern})
+		defer caller.Shutdown(context.Background())
+		go caller.Serve(NewPacketMux())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		msg, _ := NewPacketMessageBuilder([]byte("noise")).WithPacketType(echoType).Build()
+		if _, err := client.WriteTo(msg, server.Addr()); err != ErrNoiseSessionRequired {
+			t.Error(pattern, "expected ErrNoiseSessionRequired before the handshake got", err)
+		}
+		if err := client.(Handshaker).Handshake(ctx, server.Addr(), serverKey.Public); err != nil {
+			t.Fatal(pattern, "error performing handshake:", err)
+		}
+		reply, err := client.(Caller).Call(ctx, msg, server.Addr())
+		if err != nil {
+			t.Fatal(pattern, "error calling over noise session:", err)
+		}
+		if string(reply.Msg()) != "noise" {
+			t.Errorf("%d expected noise got %q", pattern, reply.Msg())
+		}
+		if !bytes.Equal(reply.PeerStaticKey(), serverKey.Public) {
+			t.Error(pattern, "expected reply to carry the server's static key")
+		}
+		reply.Release()
+		if key := <-peerKeys; !bytes.Equal(key, callerKey.Public) {
+			t.Error(pattern, "expected handler to see the caller's static key")
+		}
+	}
+}
+
+func TestNoiseHandshakeErrors(t *testing.T) {
+	serverKey, _ := GenerateNoiseKeypair()
+	callerKey, _ := GenerateNoiseKeypair()
+	otherKey, _ := GenerateNoiseKeypair()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	plain, plainClient, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating plaintext endpoint:", err)
+	}
+	defer plain.Shutdown(context.Background())
+	if err := plainClient.(Handshaker).Handshake(ctx, plain.Addr(), nil); err != ErrNoiseDisabled {
+		t.Error("Expected ErrNoiseDisabled got", err)
+	}
+
+	server, _ := newNoiseEndpoint(t, NoiseConfig{
+		StaticKeypair: serverKey,
+		Authorize: func(peerStaticKey []byte) bool {
+			return !bytes.Equal(peerStaticKey, otherKey.Public)
+		},
+	})
+	defer server.Shutdown(context.Background())
+	go server.Serve(NewPacketMux())
+
+	caller, client := newNoiseEndpoint(t, NoiseConfig{StaticKeypair: callerKey, Pattern: NoiseXX})
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+	if err := client.(Handshaker).Handshake(ctx, server.Addr(), otherKey.Public); err != ErrPeerStaticKeyMismatch {
+		t.Error("Expected ErrPeerStaticKeyMismatch got", err)
+	}
+
+	rejected, rejectedClient := newNoiseEndpoint(t, NoiseConfig{StaticKeypair: otherKey, HandshakeTimeout: time.Millisecond * 300})
+	defer rejected.Shutdown(context.Background())
+	go rejected.Serve(NewPacketMux())
+	if err := rejectedClient.(Handshaker).Handshake(ctx, server.Addr(), nil); err != ErrPeerStaticKeyRequired {
+		t.Error("Expected ErrPeerStaticKeyRequired got", err)
+	}
+	if err := rejectedClient.(Handshaker).Handshake(ctx, server.Addr(), serverKey.Public); err != ErrHandshakeTimeout {
+		t.Error("Expected unauthorized handshake to time out got", err)
+	}
+
+	// plaintext from peers without a session is dropped
+	before := server.Stats().Dropped[DropReasonUnauthenticated]
+	if before == 0 {
+		t.Error("Expected unauthorized handshake to be dropped")
+	}
+	msg, _ := NewPacketMessageBuilder([]byte("plain")).WithPacketType(echoType).Build()
+	plainClient.WriteTo(msg, server.Addr())
+	deadline := time.Now().Add(time.Second)
+	for server.Stats().Dropped[DropReasonUnauthenticated] == before {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for plaintext drop")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestNoiseReplayedInit(t *testing.T) {
+	serverKey, _ := GenerateNoiseKeypair()
+	callerKey, _ := GenerateNoiseKeypair()
+	server := newTestNoiseEndpoint(t, NoiseConfig{StaticKeypair: serverKey})
+	caller := newTestNoiseEndpoint(t, NoiseConfig{StaticKeypair: callerKey})
+	addr := caller.conn.LocalAddr()
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	now := time.Now()
+
+	h, err := caller.noise.initiate(NoiseIK, server.conn.LocalAddr(), serverKey.Public, now)
+	if err != nil {
+		t.Fatal("Error creating init message:", err)
+	}
+	response, err := server.noise.acceptInit(h.frame, addr, now)
+	if err != nil {
+		t.Fatal("Error accepting init message:", err)
+	}
+	if server.noise.session(addr) != nil {
+		t.Error("Expected session not to be used before it is confirmed")
+	}
+	if _, err := server.noise.acceptInit(h.frame, other, now); err != ErrReplayedHandshake {
+		t.Error("Expected ErrReplayedHandshake for a replayed init got", err)
+	}
+
+	confirm, err := caller.noise.acceptResponse(response)
+	if err != nil {
+		t.Fatal("Error accepting response:", err)
+	}
+	if err := <-h.done; err != nil {
+		t.Fatal("Expected handshake to complete got", err)
+	}
+	if _, ok := server.receiveNoiseTransport(NewPacket(confirm, addr, now)); ok {
+		t.Error("Expected confirmation to be consumed")
+	}
+	established := server.noise.session(addr)
+	if established == nil {
+		t.Fatal("Expected confirmed session to be used")
+	}
+
+	// a new handshake does not replace the session until it is confirmed
+	h, err = caller.noise.initiate(NoiseIK, server.conn.LocalAddr(), serverKey.Public, now)
+	if err != nil {
+		t.Fatal("Error creating init message:", err)
+	}
+	if _, err := server.noise.acceptInit(h.frame, addr, now); err != nil {
+		t.Fatal("Error accepting init message:", err)
+	}
+	if server.noise.session(addr) != established {
+		t.Error("Expected established session to be kept until the new one is confirmed")
+	}
+}
+
+func TestNoiseCookie(t *testing.T) {
+	serverKey, _ := GenerateNoiseKeypair()
+	callerKey, _ := GenerateNoiseKeypair()
+	server := newTestNoiseEndpoint(t, NoiseConfig{StaticKeypair: serverKey})
+	server.noise.loadThreshold = 0
+	caller := newTestNoiseEndpoint(t, NoiseConfig{StaticKeypair: callerKey})
+	addr := caller.conn.LocalAddr()
+	serverAddr := server.conn.LocalAddr()
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	now := time.Now()
+
+	h, err := caller.noise.initiate(NoiseXX, serverAddr, nil, now)
+	if err != nil {
+		t.Fatal("Error creating init message:", err)
+	}
+	reply, err := server.noise.acceptInit(h.frame, addr, now)
+	if err != nil || reply[2] != noiseCookie {
+		t.Fatal("Expected a cookie under load got", err)
+	}
+	if len(server.noise.handshakes) != 0 {
+		t.Error("Expected no handshake state without a cookie")
+	}
+	if err := caller.noise.acceptCookie(reply, other); err != ErrUnknownNoiseSession {
+		t.Error("Expected cookie from another address to be rejected got", err)
+	}
+	if err := caller.noise.acceptCookie(reply, serverAddr); err != nil {
+		t.Fatal("Error accepting cookie:", err)
+	}
+	select {
+	case <-h.resend:
+	default:
+		t.Error("Expected cookie to trigger a retransmission")
+	}
+
+	if reply, err := server.noise.acceptInit(h.frame, other, now); err != nil || reply[2] != noiseCookie {
+		t.Error("Expected cookie issued to another address to be rejected got", err)
+	}
+	reply, err = server.noise.acceptInit(h.frame, addr, now)
+	if err != nil || reply[2] != noiseResponse {
+		t.Error("Expected init with a valid cookie to be answered got", err)
+	}
+}
@@ -0,0 +1,116 @@
+package hacket
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Observer receives events from a PacketServer that would otherwise be
+// invisible to the application. Methods are called synchronously from the
+// server's read loop or workers and should return quickly. Packets are only
+// valid until the method returns. Embed NopObserver to implement a subset of
+// the methods.
+type Observer interface {
+	// OnReadError is called when reading from the connection fails. Read
+	// deadline timeouts are not reported
+	OnReadError(err error)
+	// OnPacketDropped is called when a received packet is discarded before it is handled
+	OnPacketDropped(packet Packet, reason DropReason)
+	// OnHandlerPanic is called when a PacketHandler panics with the recovered
+	// value and the stack trace of the panic
+	OnHandlerPanic(packet Packet, value interface{}, stack []byte)
+	// OnUnknownType is called when a PacketMux has no PacketHandler for a packet's PacketType
+	OnUnknownType(packet Packet, pktType PacketType)
+	// OnShutdown is called once the server has shut down with the result of Shutdown
+	OnShutdown(err error)
+}
+
+// NopObserver implements Observer by ignoring every event
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+// OnReadError statifies the Observer interface
+func (NopObserver) OnReadError(err error) {}
+
+// OnPacketDropped statifies the Observer interface
+func (NopObserver) OnPacketDropped(packet Packet, reason DropReason) {}
+
+// OnHandlerPanic statifies the Observer interface
+func (NopObserver) OnHandlerPanic(packet Packet, value interface{}, stack []byte) {}
+
+// OnUnknownType statifies the Observer interface
+func (NopObserver) OnUnknownType(packet Packet, pktType PacketType) {}
+
+// OnShutdown statifies the Observer interface
+func (NopObserver) OnShutdown(err error) {}
+
+// LogLevel is the severity of a log entry
+type LogLevel uint8
+
+const (
+	// LevelDebug is used for events that are expected during normal operation
+	LevelDebug LogLevel = iota
+	// LevelInfo is used for notable events
+	LevelInfo
+	// LevelWarn is used for unexpected events hacket recovered from
+	LevelWarn
+	// LevelError is used for failures
+	LevelError
+)
+
+// String returns the name of the LogLevel
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", uint8(l))
+	}
+}
+
+// Logger is a structured logger. keyvals alternate between a string key and
+// its value, for example Log(LevelWarn, "late reply", "from", addr). Adapters
+// for logging libraries only need to implement this method
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// stdLogger writes logfmt style entries to a *log.Logger
+type stdLogger struct {
+	l        *log.Logger
+	minLevel LogLevel
+}
+
+// NewStdLogger returns a Logger that writes entries at or above minLevel to l
+// formatted as key=value pairs. A nil l writes to the standard logger
+func NewStdLogger(l *log.Logger, minLevel LogLevel) Logger {
+	return &stdLogger{l: l, minLevel: minLevel}
+}
+
+func (sl *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < sl.minLevel {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%q", keyvals[i], fmt.Sprint(value))
+	}
+	if sl.l == nil {
+		log.Print(b.String())
+		return
+	}
+	sl.l.Print(b.String())
+}
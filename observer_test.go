@@ -0,0 +1,147 @@
+package hacket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	NopObserver
+	mu       sync.Mutex
+	unknown  []PacketType
+	dropped  []DropReason
+	shutdown chan error
+}
+
+func (ro *recordingObserver) OnUnknownType(packet Packet, pktType PacketType) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.unknown = append(ro.unknown, pktType)
+}
+
+func (ro *recordingObserver) OnPacketDropped(packet Packet, reason DropReason) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.dropped = append(ro.dropped, reason)
+}
+
+func (ro *recordingObserver) OnShutdown(err error) {
+	ro.shutdown <- err
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{shutdown: make(chan error, 1)}
+	server, client, err := New("udp", "127.0.0.1:0", WithObserver(observer))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	handled := make(chan struct{}, 1)
+	mux := NewPacketMux()
+	mux.NotFoundHandlerFunc(func(packet Packet, pw PacketWriter) {
+		handled <- struct{}{}
+	})
+	go server.Serve(mux)
+
+	// a truncated call frame is malformed
+	client.WriteTo(PacketMessage{headerEscape, byte(frameCallRequest), 1}, server.Addr())
+	unknown, _ := NewPacketMessageBuilder([]byte("unknown")).WithPacketType(PacketType(99)).Build()
+	client.WriteTo(unknown, server.Addr())
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for packet")
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal("Error shutting down:", err)
+	}
+	select {
+	case err := <-observer.shutdown:
+		if err != nil {
+			t.Error("Expected nil shutdown error got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for OnShutdown")
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.unknown) != 1 || observer.unknown[0] != 99 {
+		t.Error("Expected unknown PacketType 99 got", observer.unknown)
+	}
+	if len(observer.dropped) != 1 || observer.dropped[0] != DropReasonMalformed {
+		t.Error("Expected one malformed drop got", observer.dropped)
+	}
+	if stats := server.Stats(); stats.Dropped[DropReasonMalformed] != 1 {
+		t.Error("Expected malformed drop to be counted got", stats.Dropped)
+	}
+}
+
+func TestReadErrorLoggedAsWarning(t *testing.T) {
+	var buf bytes.Buffer
+	m := newMonitor(&packetOptions{Observer: NopObserver{}, Logger: NewStdLogger(log.New(&buf, "", 0), LevelWarn)})
+	m.readError(errors.New("connection refused"))
+	want := `level=warn msg="read from connection failed" err="connection refused"`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("Expected %s got %s", want, got)
+	}
+}
+
+func TestReadTimeoutLoggedAsDebug(t *testing.T) {
+	var buf bytes.Buffer
+	m := newMonitor(&packetOptions{Observer: NopObserver{}, Logger: NewStdLogger(log.New(&buf, "", 0), LevelWarn)})
+	if m.readError(os.ErrDeadlineExceeded) {
+		t.Error("Expected read timeout not to stop serving")
+	}
+	if buf.Len() != 0 || m.snapshot().ReadErrors != 0 {
+		t.Errorf("Expected read timeout to be ignored got %s and %d read errors", buf.String(), m.snapshot().ReadErrors)
+	}
+}
+
+func TestServeReturnsOnClosedConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	var buf bytes.Buffer
+	server, _, err := NewFromConn(conn, WithReadDeadline(time.Millisecond), WithLogger(NewStdLogger(log.New(&buf, "", 0), LevelWarn)))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(NewPacketMux()) }()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Error("Expected net.ErrClosed got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for Serve to return")
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("Expected only the closed connection logged got %s", buf.String())
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LevelWarn)
+	logger.Log(LevelDebug, "hidden")
+	logger.Log(LevelError, "read failed", "err", "timeout", "odd")
+	got := strings.TrimSpace(buf.String())
+	want := `level=error msg="read failed" err="timeout" odd="(missing)"`
+	if got != want {
+		t.Errorf("Expected %s got %s", want, got)
+	}
+}
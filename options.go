@@ -1,6 +1,8 @@
 package hacket
 
-import "time"
+import (
+	"time"
+)
 
 // packetOptions config options for packets
 type packetOptions struct {
@@ -8,7 +10,41 @@ type packetOptions struct {
 	ReadBufferSize   int
 	WriteDeadline    time.Duration
 	ReadDeadline     time.Duration
+	HandlerTimeout   time.Duration
+	PanicReply       bool
 	ConcurrencyLimit uint32
+
+	UnmatchedReplyHandler func(packet Packet, err error)
+
+	RetransmitTimeout    time.Duration
+	MaxRetransmitTimeout time.Duration
+	MaxTransmissions     int
+
+	BatchSize int
+
+	PeerQueueSize   int
+	PeerQueuePolicy OverflowPolicy
+
+	Priorities          map[PacketType]Priority
+	ReservedConcurrency uint32
+	QueueSize           int
+
+	Overload        bool
+	OverloadPolicy  OverflowPolicy
+	ShedPacketTypes map[PacketType]bool
+	DropHandler     func(packet Packet, reason DropReason)
+
+	Observer Observer
+	Logger   Logger
+
+	Keyring      *Keyring
+	ReplayMaxAge time.Duration
+	Noise        *NoiseConfig
+	DTLS         *DTLSConfig
+
+	FragmentSize       int
+	ReassemblyTimeout  time.Duration
+	MaxReassemblyBytes int
 }
 
 // Options interface for applying service options
@@ -57,6 +93,24 @@ func WithWriteDeadline(t time.Duration) Options {
 	})
 }
 
+// WithHandlerTimeout sets how long a PacketHandler has to handle a packet before
+// the packet's context is cancelled. Handlers are expected to return once the
+// context is done
+func WithHandlerTimeout(t time.Duration) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.HandlerTimeout = t
+	})
+}
+
+// WithPanicReply replies to the sender with an ErrorCodeHandlerPanic error
+// packet when a PacketHandler panics. Callers waiting in PacketClient.Call
+// receive a *PacketError instead of waiting for their context to expire
+func WithPanicReply() Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.PanicReply = true
+	})
+}
+
 // WithReadDeadline duration until conn's read deadline is triggered
 func WithReadDeadline(t time.Duration) Options {
 	return newFuncPacketOption(func(o *packetOptions) {
@@ -71,12 +125,258 @@ func WithConcurrencyLimit(l uint32) Options {
 	})
 }
 
+// WithUnmatchedReplyHandler sets the function called when a call reply is received
+// that does not match a waiting Call. err is ErrLateReply when the call already
+// completed, timed out or was cancelled and ErrUnmatchedReply when no call with
+// the correlation ID was sent to the address the reply came from. By default
+// these replies are logged at LevelWarn
+func WithUnmatchedReplyHandler(f func(packet Packet, err error)) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		if f != nil {
+			o.UnmatchedReplyHandler = f
+		}
+	})
+}
+
+// WithRetransmitTimeout sets how long WriteReliable waits for an acknowledgement
+// before retransmitting. The timeout doubles after every transmission up to max.
+// A zero max allows the timeout to grow without bound
+func WithRetransmitTimeout(initial time.Duration, max time.Duration) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.RetransmitTimeout = initial
+		o.MaxRetransmitTimeout = max
+	})
+}
+
+// WithMaxTransmissions number of times WriteReliable sends a message, including
+// the first transmission, before reporting ErrDeliveryFailed. Values below 1
+// are treated as 1 so the message is always sent
+func WithMaxTransmissions(n int) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		if n < 1 {
+			n = 1
+		}
+		o.MaxTransmissions = n
+	})
+}
+
+// WithBatchSize number of datagrams read per system call by a UDP PacketServer.
+// On Linux datagrams are read with recvmmsg, other platforms and non UDP
+// connections read a single datagram at a time. Each datagram in the batch
+// uses a read buffer of the maximum datagram size. A size of 1 or less
+// disables batching
+func WithBatchSize(n int) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.BatchSize = n
+	})
+}
+
+// WithOrderedDispatch handles the packets from each peer strictly in the order
+// they arrived while packets from different peers are still handled in parallel
+// by up to the concurrency limit workers. Each peer may have up to queueSize
+// packets waiting to be handled, policy decides what happens to packets that
+// arrive from a peer whose queue is full. Peers are identified by Packet.FromAddr.
+// OverflowShed is not supported and ordered dispatch can not be combined with
+// WithOverloadPolicy, WithPriority or WithReservedConcurrency, New returns an
+// error for either
+func WithOrderedDispatch(queueSize int, policy OverflowPolicy) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.PeerQueueSize = queueSize
+		o.PeerQueuePolicy = policy
+	})
+}
+
+// WithPriority assigns priority to the supplied PacketTypes. Waiting packets are
+// handled highest priority first, so PriorityHigh PacketTypes such as heartbeats
+// are not stuck behind bulk traffic. Priorities can not be combined with ordered dispatch
+func WithPriority(priority Priority, pktTypes ...PacketType) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		if o.Priorities == nil {
+			o.Priorities = make(map[PacketType]Priority)
+		}
+		for _, pktType := range pktTypes {
+			o.Priorities[pktType] = priority
+		}
+	})
+}
+
+// WithReservedConcurrency starts n workers, in addition to the concurrency
+// limit, that only handle PriorityHigh packets. PriorityHigh packets are then
+// handled even while every other worker is busy with slow handlers
+func WithReservedConcurrency(n uint32) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.ReservedConcurrency = n
+	})
+}
+
+// WithQueueSize number of packets of each priority that may wait for a worker
+// when an overload policy, priorities or reserved concurrency are used. The
+// overload policy decides what happens when the queue for a packet's priority is full
+func WithQueueSize(n int) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.QueueSize = n
+	})
+}
+
+// WithOverloadPolicy queues packets that arrive while every worker is busy,
+// up to the queue size for each priority, instead of leaving them in the
+// socket's receive buffer. policy decides what happens to packets that arrive
+// while the queue is full. shed lists the PacketTypes that may be discarded
+// by OverflowShed. Every discarded packet is counted and reported to the drop handler
+func WithOverloadPolicy(policy OverflowPolicy, shed ...PacketType) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.Overload = true
+		o.OverloadPolicy = policy
+		o.ShedPacketTypes = make(map[PacketType]bool, len(shed))
+		for _, pktType := range shed {
+			o.ShedPacketTypes[pktType] = true
+		}
+	})
+}
+
+// WithDropHandler sets a function called for every packet discarded before it
+// was handled, such as by an overload or peer queue policy. It is called from the
+// server's read loop or workers so it should return quickly. The packet is only
+// valid until the function returns
+func WithDropHandler(f func(packet Packet, reason DropReason)) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.DropHandler = f
+	})
+}
+
+// WithObserver sets the Observer notified of read errors, dropped packets,
+// handler panics, unknown PacketTypes and shutdown
+func WithObserver(observer Observer) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		if observer != nil {
+			o.Observer = observer
+		}
+	})
+}
+
+// WithLogger sets the Logger used for library errors and events. By default
+// entries at LevelInfo and above are written to the standard logger
+func WithLogger(logger Logger) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		if logger != nil {
+			o.Logger = logger
+		}
+	})
+}
+
+// WithKeyring seals every datagram written with the Keyring's primary key and
+// opens every datagram read before it is handled. Datagrams that cannot be
+// authenticated are dropped with DropReasonUnauthenticated, so every peer must
+// share the keys. Sealed datagrams are protected against replay, see
+// WithReplayMaxAge. Sealing adds up to 69 bytes to each datagram
+func WithKeyring(keyring *Keyring) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.Keyring = keyring
+	})
+}
+
+// WithReplayMaxAge sets how long after it was sealed a datagram is accepted
+// when a Keyring is configured. Every sealed datagram carries a counter that
+// is checked against a sliding window for its sender, so a datagram is only
+// accepted once. Datagrams sealed longer ago, or further in the future, than
+// maxAge are dropped with DropReasonStale, which requires peers to have loosely
+// synchronised clocks. A maxAge of zero disables the age check, in which case
+// the datagrams of a sender can be replayed once it has been forgotten
+func WithReplayMaxAge(maxAge time.Duration) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.ReplayMaxAge = maxAge
+	})
+}
+
+// WithNoise enables Noise handshakes that establish a session with each peer.
+// Once PacketClient.Handshake has established a session with an address, every
+// datagram written to it is encrypted for that peer and handlers see the peer's
+// static public key with Packet.PeerStaticKey. Peers handshaking with this
+// endpoint are answered as long as config.Authorize accepts them. Datagrams
+// from peers without a session are dropped unless a Keyring opens them or
+// config.AllowPlaintext is set
+func WithNoise(config NoiseConfig) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.Noise = &config
+	})
+}
+
+// WithDTLS configures the DTLS 1.2 transport selected by passing the "dtls",
+// "dtls4" or "dtls6" network to New. It is ignored by other transports, see
+// NewDTLSPacketConn to secure a connection passed to NewFromConn
+func WithDTLS(config DTLSConfig) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.DTLS = &config
+	})
+}
+
+// WithFragmentation enables splitting messages larger than size bytes into
+// fragments of at most size bytes, including the fragment header and any encryption
+// overhead added by a Keyring or Noise session, and reassembling
+// fragmented messages before they are handled. size should not exceed the path MTU
+// less the IP and UDP headers, for example 1472 on a standard ethernet network.
+// Both peers must enable fragmentation
+func WithFragmentation(size int) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.FragmentSize = size
+	})
+}
+
+// WithReassemblyTimeout duration an incomplete fragmented message is kept while
+// waiting for its remaining fragments
+func WithReassemblyTimeout(t time.Duration) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.ReassemblyTimeout = t
+	})
+}
+
+// WithMaxReassemblyBytes total number of bytes buffered for incomplete fragmented
+// messages, including the memory used to track each expected fragment. The oldest
+// incomplete messages are discarded when the limit is exceeded
+func WithMaxReassemblyBytes(n int) Options {
+	return newFuncPacketOption(func(o *packetOptions) {
+		o.MaxReassemblyBytes = n
+	})
+}
+
 func defaultPacketOption() *packetOptions {
 	return &packetOptions{
-		ReadBufferSize:   0, // use go upd socket size default
-		WriteBufferSize:  0, // use go udp socket size default
-		WriteDeadline:    0, // no deadline by default
-		ReadDeadline:     0, // no deadline by default
-		ConcurrencyLimit: 1, // process one packet at a time
+		ReadBufferSize:   0,     // use go upd socket size default
+		WriteBufferSize:  0,     // use go udp socket size default
+		WriteDeadline:    0,     // no deadline by default
+		ReadDeadline:     0,     // no deadline by default
+		HandlerTimeout:   0,     // handlers are only cancelled by Shutdown
+		PanicReply:       false, // recover from handler panics without replying
+		ConcurrencyLimit: 1,     // process one packet at a time
+
+		UnmatchedReplyHandler: nil, // log unmatched replies
+
+		RetransmitTimeout:    time.Millisecond * 200, // first retransmit after 200ms
+		MaxRetransmitTimeout: time.Second * 5,        // back off to at most 5s between retransmits
+		MaxTransmissions:     5,                      // give up after 5 transmissions
+
+		BatchSize: 0, // read one datagram per system call
+
+		PeerQueueSize:   0,             // packets are handled by the next free worker
+		PeerQueuePolicy: OverflowBlock, // wait for room in a full peer queue
+
+		Priorities:          nil,  // every PacketType has PriorityNormal
+		ReservedConcurrency: 0,    // no workers reserved for PriorityHigh
+		QueueSize:           1024, // up to 1024 packets of each priority wait for a worker
+
+		Overload:       false,         // stop reading while every worker is busy
+		OverloadPolicy: OverflowBlock, // wait for room in a full queue
+
+		Observer: NopObserver{},                // ignore events
+		Logger:   NewStdLogger(nil, LevelInfo), // log info and above to the standard logger
+
+		Keyring:      nil,             // datagrams are sent in plaintext
+		ReplayMaxAge: time.Minute * 2, // reject sealed datagrams more than 2 minutes old
+		Noise:        nil,             // Noise handshakes disabled by default
+		DTLS:         nil,             // the dtls networks require WithDTLS
+
+		FragmentSize:       0,               // fragmentation disabled by default
+		ReassemblyTimeout:  time.Second * 5, // drop incomplete messages after 5s
+		MaxReassemblyBytes: 4 << 20,         // buffer at most 4MiB of incomplete messages
 	}
 }
@@ -1,8 +1,10 @@
 package hacket
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -10,47 +12,88 @@ const (
 	// udpPacketBufSize is used to buffer incoming packets during read
 	// operations.
 	udpPacketBufSize = 65506 // (sizeof(IP Header) + sizeof(UDP Header) + sizeof(hacket header)) = 65535-(20+8+1) = 65506
+	// maxMessageSize is the largest message Build accepts by default. It leaves
+	// room for the largest encryption overhead so sealed messages still fit in
+	// a single datagram
+	maxMessageSize = udpPacketBufSize - maxSealOverhead
 )
 
 // PacketMessage is a custom byte slice used to create a network packet
 type PacketMessage []byte
 
 // PacketType defines the type of message to expect as the network packets payload
-// Additonally, PacketType is used by the PacketMux during handler selection
-type PacketType uint8
+// Additonally, PacketType is used by the PacketMux during handler selection.
+// PacketTypes up to 255 are sent with a one byte header understood by every
+// version of hacket, larger PacketTypes and PacketType 0xF8 are sent with a
+// versioned header. Raw PacketMessages must not start with the byte 0xF8
+type PacketType uint16
+
+var (
+	packetTypeNamesMu sync.RWMutex
+	packetTypeNames   = map[PacketType]string{
+		PacketTypeError: "error",
+	}
+)
+
+// RegisterPacketTypeName sets a descriptive name for pktType that is returned
+// by PacketType.String and reported by PacketMux.Routes. Registering a name
+// again replaces it.
+func RegisterPacketTypeName(pktType PacketType, name string) {
+	packetTypeNamesMu.Lock()
+	packetTypeNames[pktType] = name
+	packetTypeNamesMu.Unlock()
+}
+
+// String returns the name registered for the PacketType or its number
+func (t PacketType) String() string {
+	packetTypeNamesMu.RLock()
+	name, ok := packetTypeNames[t]
+	packetTypeNamesMu.RUnlock()
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("PacketType(%d)", uint16(t))
+}
 
 // PacketMessageBuilder provides a function chain to create either a raw
 // PacketMessage without a PacketType or to create a PacketMessage with a
 // prepended PacketType. This is used my the PacketMux when selecting
 // a packet Handler.
 type PacketMessageBuilder struct {
-	m       PacketMessage
-	pktType *PacketType
+	m         PacketMessage
+	pktType   *PacketType
+	maxSize   int
+	versioned bool
+	checksum  bool
 }
 
 // NewPacketMessageBuilder initializes a new PacketMessageBuilder with b
 // If b is nil the PacketMessage Builder will throw an error during the build call.
 func NewPacketMessageBuilder(b []byte) *PacketMessageBuilder {
-	return &PacketMessageBuilder{m: b}
+	return &PacketMessageBuilder{m: b, maxSize: maxMessageSize}
 }
 
 // Build creates a PacketMessage with the bytes supplied when the PacketMessageBuilder was created
-// If a PacketType has been set, it will be prepended to the PacketMessage
+// If a PacketType has been set, it will be prepended to the PacketMessage. ErrMaxMessageSize is
+// returned when the message, including its header and trailer, is larger than the maximum message size
 func (mb *PacketMessageBuilder) Build() (PacketMessage, error) {
 	if mb.m == nil {
 		return nil, ErrNilByteSlice
 	}
-	if len(mb.m) > udpPacketBufSize {
-		return nil, ErrMaxMessageSize
-	}
-	if mb.pktType != nil {
-		encodedMsg, err := encode(*mb.pktType, mb.m)
-		if err != nil {
-			return nil, err
+	if mb.pktType == nil {
+		if len(mb.m) > mb.maxSize {
+			return nil, ErrMaxMessageSize
 		}
-		return encodedMsg, nil
+		return mb.m, nil
+	}
+	var flags headerFlags
+	if mb.checksum {
+		flags |= flagChecksum
 	}
-	return mb.m, nil
+	if encodedSize(*mb.pktType, len(mb.m), flags, mb.versioned) > mb.maxSize {
+		return nil, ErrMaxMessageSize
+	}
+	return encode(*mb.pktType, mb.m, flags, mb.versioned)
 }
 
 // WithPacketType sets a PacketType to be prepended to a PacketMessage
@@ -59,40 +102,78 @@ func (mb *PacketMessageBuilder) WithPacketType(pktType PacketType) *PacketMessag
 	return mb
 }
 
-// encode prepends a PacketType to a PacketMessage
-func encode(pktType PacketType, b []byte) (PacketMessage, error) {
+// WithVersionedHeader sends the PacketType in the versioned header even when it
+// fits in the legacy one byte header. PacketTypes above 255 always use the
+// versioned header. Peers running a version of hacket without versioned header
+// support only understand the legacy header
+func (mb *PacketMessageBuilder) WithVersionedHeader() *PacketMessageBuilder {
+	mb.versioned = true
+	return mb
+}
+
+// WithChecksum appends a CRC32C trailer that the receiving PacketMux verifies
+// before dispatch. Corrupted messages are dropped with DropReasonChecksum. The
+// message is sent with the versioned header, so peers must support it. Use
+// PacketMux.RequireChecksum to reject messages of a PacketType without one
+func (mb *PacketMessageBuilder) WithChecksum() *PacketMessageBuilder {
+	mb.checksum = true
+	return mb
+}
+
+// WithMaxMessageSize raises or lowers the largest message Build accepts, including
+// its header and trailer. The default leaves room for the encryption added by a
+// Keyring or Noise session. Messages larger than a single datagram can only be
+// sent when fragmentation is enabled
+func (mb *PacketMessageBuilder) WithMaxMessageSize(size int) *PacketMessageBuilder {
+	mb.maxSize = size
+	return mb
+}
+
+// encode prepends the header for pktType to a PacketMessage and appends any
+// trailer required by flags
+func encode(pktType PacketType, b []byte, flags headerFlags, versioned bool) (PacketMessage, error) {
 	if b == nil {
 		return nil, ErrNilByteSlice
 	}
-	buf := bytes.NewBuffer(nil)
-	if err := buf.WriteByte(uint8(pktType)); err != nil {
-		return nil, err
-	}
-	n, err := buf.Write(b)
-	if n != len(b) {
-		return nil, ErrByteWrite
+	msg := appendHeader(make([]byte, 0, headerV1Size+len(b)+checksumSize), pktType, flags, versioned)
+	msg = append(msg, b...)
+	if flags&flagChecksum != 0 {
+		msg = appendChecksum(msg)
 	}
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return msg, nil
 }
 
-// decode will return the first byte of the PacketMessage. It is the responsibility of the caller
-// to ensure that the first byte is a valid packet type.PacketMessage will contain the remainder
-// of the byte slice
+// decode returns the PacketType from the header of the PacketMessage along with
+// the message that follows the header. It is the responsibility of the caller to
+// ensure that the PacketType is valid
 func decode(b []byte) (PacketType, PacketMessage, error) {
-	pktType := PacketType(b[0])
-	return pktType, b[1:], nil
+	h, msg, err := decodeMessage(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return h.pktType, msg, nil
 }
 
 // Packet is used to wrap incoming network packets from peers
 // over a packet connection. Additionally it provides Meta data about
 // the packet.
+//
+// Packets received by a PacketServer hold their message in a pooled buffer.
+// The message is only valid until the PacketHandler returns, at which point the
+// server releases the buffer for reuse. A handler that keeps the message after
+// returning, for example by passing the Packet to another goroutine, must call
+// Retain before returning and Release once it is done with the message, or copy
+// the message. This is a breaking change: earlier releases gave every Packet its
+// own buffer, so handlers that retained messages without copying them must be
+// updated.
 type Packet struct {
 	msg       PacketMessage
 	fromAddr  net.Addr
 	timestamp time.Time
+	buf       *packetBuffer
+	mon       *monitor
+	ctx       context.Context
+	peerKey   []byte
 }
 
 // NewPacket returns a new packet
@@ -123,3 +204,43 @@ func (p *Packet) FromAddr() net.Addr {
 func (p *Packet) Timestamp() time.Time {
 	return p.timestamp
 }
+
+// Context returns the packet's context. Packets received by a PacketServer
+// carry a context that is cancelled when the server is shut down or the
+// configured handler timeout expires. Packets created with NewPacket return
+// context.Background
+func (p *Packet) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// SetContext sets the context of the packet. Middleware can use SetContext to
+// add request scoped values before calling the next PacketHandler
+func (p *Packet) SetContext(ctx context.Context) {
+	p.ctx = ctx
+}
+
+// PeerStaticKey returns the Noise static public key of the peer that sent the
+// packet. It is nil unless the packet was received over a Noise session
+func (p *Packet) PeerStaticKey() []byte {
+	return p.peerKey
+}
+
+// Retain keeps the packet's message valid after the PacketHandler returns.
+// Every call to Retain must be matched by a call to Release
+func (p *Packet) Retain() {
+	if p.buf != nil {
+		p.buf.retain()
+	}
+}
+
+// Release gives up a reference to the packet's message. Once every reference
+// is released the message must no longer be used. Release is a no-op for
+// packets created with NewPacket
+func (p *Packet) Release() {
+	if p.buf != nil {
+		p.buf.release()
+	}
+}
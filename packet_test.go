@@ -3,6 +3,7 @@ package hacket
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 // testaPacketHandler - dummy function used for lookup tests
@@ -91,3 +92,63 @@ func TestMessageBuilderNil(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMessageBuilderMaxSize(t *testing.T) {
+	body := make([]byte, 99)
+	testcases := []struct {
+		name    string
+		builder *PacketMessageBuilder
+		err     error
+	}{
+		{name: "raw", builder: NewPacketMessageBuilder(make([]byte, 100)), err: nil},
+		{name: "legacy header", builder: NewPacketMessageBuilder(body).WithPacketType(1), err: nil},
+		{name: "versioned header", builder: NewPacketMessageBuilder(body).WithPacketType(1).WithVersionedHeader(), err: ErrMaxMessageSize},
+		{name: "checksum", builder: NewPacketMessageBuilder(body[:91]).WithPacketType(1).WithChecksum(), err: nil},
+		{name: "checksum trailer", builder: NewPacketMessageBuilder(body[:92]).WithPacketType(1).WithChecksum(), err: ErrMaxMessageSize},
+	}
+	for _, tt := range testcases {
+		msg, err := tt.builder.WithMaxMessageSize(100).Build()
+		if err != tt.err {
+			t.Errorf("%s expected %v got %v", tt.name, tt.err, err)
+		}
+		if err == nil && len(msg) > 100 {
+			t.Errorf("%s built %d bytes, larger than the maximum", tt.name, len(msg))
+		}
+	}
+}
+
+func TestBufferClass(t *testing.T) {
+	testcases := []struct {
+		size int
+		want int
+	}{
+		{size: 1, want: 0},
+		{size: 64, want: 0},
+		{size: 65, want: 1},
+		{size: 1500, want: 5},
+		{size: udpPacketBufSize, want: bufferClasses - 1},
+	}
+	for _, tt := range testcases {
+		if got := bufferClass(tt.size); got != tt.want {
+			t.Errorf("bufferClass(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestPacketRetainRelease(t *testing.T) {
+	pb := getBuffer([]byte("retained"))
+	packet := Packet{msg: pb.b, buf: pb}
+	packet.Retain()
+	packet.Release()
+	if string(packet.Msg()) != "retained" || pb.refs != 1 {
+		t.Fatal("Expected retained packet to keep its message")
+	}
+	packet.Release()
+	if pb.refs != 0 {
+		t.Errorf("Expected no references after release, have %d", pb.refs)
+	}
+	// packets created with NewPacket are not pooled
+	unpooled := NewPacket([]byte("unpooled"), nil, time.Now())
+	unpooled.Retain()
+	unpooled.Release()
+}
@@ -1,8 +1,8 @@
 package hacket
 
 import (
+	"context"
 	"net"
-	"time"
 )
 
 // PacketClient defines a packet client interface
@@ -10,30 +10,90 @@ type PacketClient interface {
 	WriteTo(msg PacketMessage, addr net.Addr) (int, error)
 }
 
-var _ PacketClient = &udpPacketClientImpl{}
+// Caller is implemented by the PacketClient returned by New and NewFromConn.
+// Check for it with a type assertion
+type Caller interface {
+	Call(ctx context.Context, msg PacketMessage, addr net.Addr) (Packet, error)
+}
 
-// udpPacketClientImpl implements the packet client interface
-type udpPacketClientImpl struct {
-	conn    net.PacketConn
-	options *packetOptions
+// Handshaker is implemented by the PacketClient returned by New and
+// NewFromConn. Check for it with a type assertion
+type Handshaker interface {
+	Handshake(ctx context.Context, addr net.Addr, peerStaticKey []byte) error
 }
 
-// NewUDPPacketClient creates a new UDP packet client
-func newUDPPacketClient(conn *net.UDPConn, options *packetOptions) *udpPacketClientImpl {
-	return &udpPacketClientImpl{
-		conn:    conn,
-		options: options,
-	}
+var (
+	_ PacketClient   = &packetClientImpl{}
+	_ ContextWriter  = &packetClientImpl{}
+	_ ReliableWriter = &packetClientImpl{}
+	_ BatchWriter    = &packetClientImpl{}
+	_ Caller         = &packetClientImpl{}
+	_ Handshaker     = &packetClientImpl{}
+)
+
+// packetClientImpl implements the packet client interface
+type packetClientImpl struct {
+	ep *endpoint
 }
 
-// WriteTo writes a packet to the target destination
-func (pc *udpPacketClientImpl) WriteTo(msg PacketMessage, address net.Addr) (int, error) {
-	if pc.options.WriteDeadline > 0 {
-		deadline := time.Now().Add(pc.options.WriteDeadline)
-		if err := pc.conn.SetWriteDeadline(deadline); err != nil {
-			return 0, err
-		}
+// newPacketClient creates a new packet client that writes to the endpoint's connection
+func newPacketClient(ep *endpoint) *packetClientImpl {
+	return &packetClientImpl{
+		ep: ep,
 	}
+}
+
+// WriteTo writes a packet to the target destination. No SpanContext is sent, so a
+// traced peer starts a new trace. Use WriteToContext to continue a trace
+func (pc *packetClientImpl) WriteTo(msg PacketMessage, address net.Addr) (int, error) {
 	// Interal packet write function
-	return pc.conn.WriteTo(msg, address)
+	return pc.ep.writeTo(msg, address)
+}
+
+// WriteToContext writes a packet to the target destination. When ctx carries a
+// SpanContext it is sent in a trace header so the peer continues the trace.
+// WriteReliable and Call propagate the SpanContext of their context the same way
+func (pc *packetClientImpl) WriteToContext(ctx context.Context, msg PacketMessage, address net.Addr) (int, error) {
+	return pc.ep.writeToContext(ctx, msg, address)
+}
+
+// WriteBatch writes each message to its address using as few system calls as
+// possible. On Linux UDP connections send the batch with sendmmsg, other
+// platforms and connections write one message at a time. The number of
+// messages written is returned along with the first error encountered
+func (pc *packetClientImpl) WriteBatch(msgs []BatchMessage) (int, error) {
+	return pc.ep.writeBatch(msgs)
+}
+
+// WriteReliable writes a packet to the target destination and waits for the remote
+// PacketServer to acknowledge it. The packet is retransmitted with exponential backoff
+// until it is acknowledged, ctx is done or the configured number of transmissions is
+// exhausted, in which case ErrDeliveryFailed is returned. Acknowledgements are read by
+// the PacketServer created with the client, so the server must be serving. Duplicate
+// deliveries caused by retransmission are discarded by the receiving server.
+func (pc *packetClientImpl) WriteReliable(ctx context.Context, msg PacketMessage, address net.Addr) error {
+	return pc.ep.writeReliable(ctx, msg, address)
+}
+
+// Call writes msg to the target destination stamped with a correlation ID and
+// waits for the remote handler to reply by writing back to the sender with its
+// PacketWriter. Replies are read by the PacketServer created with the client,
+// so the server must be serving for Call to complete. Call returns when a reply
+// is received, ctx is done or the server is shut down. When the peer replies
+// with an error packet the reply is returned along with a *PacketError. The
+// reply may be released with Packet.Release once it is no longer needed.
+func (pc *packetClientImpl) Call(ctx context.Context, msg PacketMessage, address net.Addr) (Packet, error) {
+	return pc.ep.call(ctx, msg, address)
+}
+
+// Handshake establishes a Noise session with the peer at addr. Once it returns
+// every datagram written to addr is encrypted for the session. peerStaticKey
+// is the static public key the peer must have. It is required for NoiseIK and
+// optional for NoiseXX, which learns the key during the handshake. The
+// handshake is retransmitted until it completes, ctx is done or the handshake
+// timeout expires. Responses are read by the PacketServer created with the
+// client, so the server must be serving. The final NoiseXX message is
+// retransmitted until the peer confirms the session
+func (pc *packetClientImpl) Handshake(ctx context.Context, address net.Addr, peerStaticKey []byte) error {
+	return pc.ep.handshake(ctx, address, peerStaticKey)
 }
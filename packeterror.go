@@ -0,0 +1,101 @@
+package hacket
+
+import (
+	"fmt"
+)
+
+// PacketTypeError is the PacketType of error reply packets. A PacketHandler may
+// be registered for it so that peers can react to errors they receive.
+const PacketTypeError PacketType = 0xFFFF
+
+// errorBodySize is the size of the ErrorCode and original PacketType at the
+// start of an error packet
+const errorBodySize = 1 + 2
+
+// ErrorCode describes why a peer replied with an error packet
+type ErrorCode uint8
+
+const (
+	// ErrorCodeUnknownPacketType the peer has no handler for the PacketType sent
+	ErrorCodeUnknownPacketType ErrorCode = iota + 1
+	// ErrorCodeHandlerPanic the peer's handler panicked while handling the packet
+	ErrorCodeHandlerPanic
+)
+
+// String returns a readable name for the ErrorCode
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeUnknownPacketType:
+		return "unknown packet type"
+	case ErrorCodeHandlerPanic:
+		return "handler panic"
+	default:
+		return fmt.Sprintf("error code %d", uint8(c))
+	}
+}
+
+// PacketError is the content of an error packet sent by a peer
+type PacketError struct {
+	Code       ErrorCode
+	PacketType PacketType
+	Message    string
+}
+
+// Error statifies the error interface
+func (pe *PacketError) Error() string {
+	if pe.Message == "" {
+		return fmt.Sprintf("peer error: %s (packet type %d)", pe.Code, pe.PacketType)
+	}
+	return fmt.Sprintf("peer error: %s (packet type %d): %s", pe.Code, pe.PacketType, pe.Message)
+}
+
+// NewErrorPacketMessage creates a PacketTypeError message reporting code for a
+// packet of pktType. message is optional human readable detail
+func NewErrorPacketMessage(code ErrorCode, pktType PacketType, message string) (PacketMessage, error) {
+	body := make([]byte, 0, errorBodySize+len(message))
+	body = append(body, uint8(code), uint8(pktType>>8), uint8(pktType))
+	return NewPacketMessageBuilder(append(body, message...)).WithPacketType(PacketTypeError).Build()
+}
+
+// IsErrorPacket reports whether msg is a PacketTypeError message
+func IsErrorPacket(msg PacketMessage) bool {
+	h, err := decodeHeader(msg)
+	return err == nil && h.pktType == PacketTypeError
+}
+
+// ParseErrorPacket decodes a PacketTypeError message, including its leading PacketType
+func ParseErrorPacket(msg PacketMessage) (*PacketError, error) {
+	h, body, err := decodeMessage(msg)
+	if err == ErrChecksumMismatch {
+		return nil, err
+	}
+	if err != nil || h.pktType != PacketTypeError {
+		return nil, ErrNotErrorPacket
+	}
+	if len(body) < errorBodySize {
+		return nil, ErrShortPacket
+	}
+	return &PacketError{
+		Code:       ErrorCode(body[0]),
+		PacketType: PacketType(body[1])<<8 | PacketType(body[2]),
+		Message:    string(body[errorBodySize:]),
+	}, nil
+}
+
+// UnknownPacketTypeHandler returns a PacketHandler that replies to the sender
+// with an ErrorCodeUnknownPacketType error packet. It is intended to be used as
+// the NotFoundHandler of a PacketMux. Error packets are never replied to so two
+// peers cannot trigger each other indefinitely.
+func UnknownPacketTypeHandler() PacketHandler {
+	return PacketHandlerFunc(func(packet Packet, pw PacketWriter) {
+		pktType, _, err := decode(packet.Msg())
+		if err != nil || pktType == PacketTypeError {
+			return
+		}
+		reply, err := NewErrorPacketMessage(ErrorCodeUnknownPacketType, pktType, "")
+		if err != nil {
+			return
+		}
+		pw.WriteTo(reply, packet.FromAddr())
+	})
+}
@@ -1,9 +1,11 @@
 package hacket
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sort"
 	"sync"
-	"time"
 )
 
 // PacketWriter interface used in handlers
@@ -11,25 +13,82 @@ type PacketWriter interface {
 	WriteTo(msg PacketMessage, addr net.Addr) (int, error)
 }
 
+// ContextWriter is implemented by PacketWriters and PacketClients that propagate
+// the SpanContext of ctx to the peer. Check for it with a type assertion
+type ContextWriter interface {
+	WriteToContext(ctx context.Context, msg PacketMessage, addr net.Addr) (int, error)
+}
+
+// ReliableWriter is implemented by PacketWriters and PacketClients that can wait
+// for the peer to acknowledge a message. Check for it with a type assertion
+type ReliableWriter interface {
+	WriteReliable(ctx context.Context, msg PacketMessage, addr net.Addr) error
+}
+
+// BatchWriter is implemented by PacketWriters and PacketClients that can write
+// several messages at once. Check for it with a type assertion
+type BatchWriter interface {
+	WriteBatch(msgs []BatchMessage) (int, error)
+}
+
+// contextBinder is implemented by the PacketWriters hacket hands to handlers.
+// withContext returns a copy of the writer whose WriteTo propagates the
+// SpanContext carried by ctx
+type contextBinder interface {
+	withContext(ctx context.Context) PacketWriter
+}
+
+var (
+	_ ContextWriter  = &hacketPacketWriter{}
+	_ ReliableWriter = &hacketPacketWriter{}
+	_ BatchWriter    = &hacketPacketWriter{}
+	_ contextBinder  = &hacketPacketWriter{}
+)
+
 // hacketPacketWriter is a Wrapper around a packetConn. PacketWriter specifically
 // wraps the Write side of a PacketConn only enforcing the PacketMessage param to
 // writeTo. This is so we can force the user into using our PacketMessage and
 // PacketMessageBuilder
 type hacketPacketWriter struct {
-	conn    net.PacketConn
-	options *packetOptions
+	ep *endpoint
+	// ctx is the context of the packet being handled by a traced PacketMux
+	ctx context.Context
 }
 
 // WriteTo wraps the internal PacketConn WriteTo. PacketMessage is the payload of the network
-// packet, Addr is the address of the remote peer we are sending to
+// packet, Addr is the address of the remote peer we are sending to. Handlers of a PacketMux
+// with a Tracer continue the trace of the packet being handled, otherwise no SpanContext is
+// sent and a traced peer starts a new trace. Use WriteToContext to continue another trace
 func (hpw *hacketPacketWriter) WriteTo(msg PacketMessage, addr net.Addr) (int, error) {
-	if hpw.options.WriteDeadline > 0 {
-		deadline := time.Now().Add(hpw.options.WriteDeadline)
-		if err := hpw.conn.SetWriteDeadline(deadline); err != nil {
-			return 0, err
-		}
+	if hpw.ctx != nil {
+		return hpw.ep.writeToContext(hpw.ctx, msg, addr)
 	}
-	return hpw.conn.WriteTo(msg, addr)
+	return hpw.ep.writeTo(msg, addr)
+}
+
+// withContext statifies the contextBinder interface
+func (hpw *hacketPacketWriter) withContext(ctx context.Context) PacketWriter {
+	return &hacketPacketWriter{ep: hpw.ep, ctx: ctx}
+}
+
+// WriteToContext writes msg to addr like WriteTo. When ctx carries a SpanContext,
+// such as the context of a packet handled by a traced PacketMux, it is sent in
+// a trace header so the peer continues the trace
+func (hpw *hacketPacketWriter) WriteToContext(ctx context.Context, msg PacketMessage, addr net.Addr) (int, error) {
+	return hpw.ep.writeToContext(ctx, msg, addr)
+}
+
+// WriteReliable writes msg to addr and waits for the remote peer to acknowledge it,
+// retransmitting with exponential backoff. ErrDeliveryFailed is returned once the
+// configured number of transmissions is exhausted
+func (hpw *hacketPacketWriter) WriteReliable(ctx context.Context, msg PacketMessage, addr net.Addr) error {
+	return hpw.ep.writeReliable(ctx, msg, addr)
+}
+
+// WriteBatch writes each message to its address. On Linux UDP connections send
+// the batch with sendmmsg. The number of messages written is returned
+func (hpw *hacketPacketWriter) WriteBatch(msgs []BatchMessage) (int, error) {
+	return hpw.ep.writeBatch(msgs)
 }
 
 // PacketHandler defines a function to handle Packets
@@ -45,15 +104,31 @@ func (s PacketHandlerFunc) HandlePacket(packet Packet, pw PacketWriter) {
 	s(packet, pw)
 }
 
+// Middleware wraps a PacketHandler to add cross cutting behaviour such as
+// logging, metrics or authorization. The returned PacketHandler is expected
+// to call the wrapped PacketHandler to continue handling the packet.
+type Middleware func(PacketHandler) PacketHandler
+
 type packetMuxEntry struct {
 	packetHandler PacketHandler
 	pktType       PacketType
+	middleware    []Middleware
+	// handler is packetHandler wrapped by the mux and route middleware
+	handler PacketHandler
 }
 
 //PacketMux allows PacketHandlers to be registered.
 type PacketMux struct {
-	mu sync.RWMutex
-	m  map[PacketType]packetMuxEntry
+	mu         sync.RWMutex
+	m          map[PacketType]packetMuxEntry
+	middleware []Middleware
+	// notFound is called for PacketTypes without a registered PacketHandler
+	notFound packetMuxEntry
+	tracer   Tracer
+	// decodeError is called when a typed handler cannot unmarshal a packet
+	decodeError DecodeErrorHandler
+	// checksums are the PacketTypes that must carry a checksum
+	checksums map[PacketType]struct{}
 }
 
 // NewPacketMux initializes a PacketMux
@@ -61,10 +136,88 @@ func NewPacketMux() *PacketMux {
 	return new(PacketMux)
 }
 
+// Use adds middleware that wraps every route on the PacketMux, including routes
+// registered before Use is called. Mux middleware runs in the order it was added
+// and before any route middleware.
+func (pmux *PacketMux) Use(middleware ...Middleware) {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	pmux.middleware = append(pmux.middleware, middleware...)
+	for pktType, entry := range pmux.m {
+		entry.handler = pmux.chain(entry)
+		pmux.m[pktType] = entry
+	}
+	if pmux.notFound.packetHandler != nil {
+		pmux.notFound.handler = pmux.chain(pmux.notFound)
+	}
+}
+
+// NotFoundHandler sets the PacketHandler called for packets whose PacketType has
+// no registered PacketHandler. The packet is passed with its PacketType still
+// prepended to the message so the handler can inspect it. Mux middleware wraps
+// the NotFoundHandler. UnknownPacketTypeHandler can be used to reply to the
+// sender with an error packet. Supplying nil removes the NotFoundHandler and
+// unknown PacketTypes are ignored
+func (pmux *PacketMux) NotFoundHandler(packetHandler PacketHandler) {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	pmux.notFound = packetMuxEntry{packetHandler: packetHandler}
+	if packetHandler != nil {
+		pmux.notFound.handler = pmux.chain(pmux.notFound)
+	}
+}
+
+// NotFoundHandlerFunc sets a PacketHandlerFunc as the NotFoundHandler
+func (pmux *PacketMux) NotFoundHandlerFunc(packetHandler func(packet Packet, pw PacketWriter)) {
+	if packetHandler == nil {
+		pmux.NotFoundHandler(nil)
+		return
+	}
+	pmux.NotFoundHandler(PacketHandlerFunc(packetHandler))
+}
+
+// SetTracer sets the Tracer used to start a span for every packet handled by
+// the PacketMux. The span continues the trace propagated by the sender and is
+// carried by the packet's context. Handlers are given a PacketWriter whose
+// WriteTo continues the trace of the packet's span. Supplying nil disables
+// tracing
+func (pmux *PacketMux) SetTracer(tracer Tracer) {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	pmux.tracer = tracer
+}
+
+// RequireChecksum drops packets of the PacketTypes that arrive without a
+// checksum, see PacketMessageBuilder.WithChecksum. Checksums are verified for
+// every PacketType that carries one, so PacketTypes that do not require a
+// checksum keep accepting packets from peers that do not send one
+func (pmux *PacketMux) RequireChecksum(pktTypes ...PacketType) {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	if pmux.checksums == nil {
+		pmux.checksums = make(map[PacketType]struct{})
+	}
+	for _, pktType := range pktTypes {
+		pmux.checksums[pktType] = struct{}{}
+	}
+}
+
+// Handler returns the PacketHandler registered for pktType wrapped by its
+// middleware. ErrPacketHandlerNotFound is returned when there is none
+func (pmux *PacketMux) Handler(pktType PacketType) (PacketHandler, error) {
+	handler := pmux.findPacketHandler(pktType)
+	if handler == nil {
+		return nil, ErrPacketHandlerNotFound
+	}
+	return handler, nil
+}
+
 // PacketHandler registers a PacketHandler with key PacketType
-// PacketType acts as the route and PacketHandler is the function to be called
-func (pmux *PacketMux) PacketHandler(pktType PacketType, packetHandler PacketHandler) error {
+// PacketType acts as the route and PacketHandler is the function to be called.
+// Route middleware runs in the order supplied after any mux middleware
+func (pmux *PacketMux) PacketHandler(pktType PacketType, packetHandler PacketHandler, middleware ...Middleware) error {
 	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
 	if packetHandler == nil {
 		return ErrNilPacketHander
 	}
@@ -74,49 +227,220 @@ func (pmux *PacketMux) PacketHandler(pktType PacketType, packetHandler PacketHan
 	if _, ok := pmux.m[pktType]; ok {
 		return ErrPacketHandlerAlreadyExists
 	}
-	pmux.m[pktType] = packetMuxEntry{packetHandler: packetHandler, pktType: pktType}
-	pmux.mu.Unlock()
+	entry := packetMuxEntry{packetHandler: packetHandler, pktType: pktType, middleware: middleware}
+	entry.handler = pmux.chain(entry)
+	pmux.m[pktType] = entry
 	return nil
 }
 
 // PacketHandlerFunc registers a PacketHandlerFunc with key PacketType
-// PacketType acts as the route and PacketHandler is the function to be called
-func (pmux *PacketMux) PacketHandlerFunc(pktType PacketType, packetHandler func(packet Packet, pw PacketWriter)) error {
+// PacketType acts as the route and PacketHandler is the function to be called.
+// Route middleware runs in the order supplied after any mux middleware
+func (pmux *PacketMux) PacketHandlerFunc(pktType PacketType, packetHandler func(packet Packet, pw PacketWriter), middleware ...Middleware) error {
+	if packetHandler == nil {
+		return ErrNilPacketHander
+	}
+	return pmux.PacketHandler(pktType, PacketHandlerFunc(packetHandler), middleware...)
+}
+
+// TypedPacketHandler registers fn for PacketType. Messages are unmarshalled with
+// codec into a new value of fn's message parameter, see NewTypedHandler.
+// Messages that cannot be unmarshalled are passed to the handler set with
+// SetDecodeErrorHandler
+func (pmux *PacketMux) TypedPacketHandler(pktType PacketType, codec Codec, fn interface{}, middleware ...Middleware) error {
+	handler, err := newTypedHandler(codec, fn, pmux.findDecodeErrorHandler)
+	if err != nil {
+		return err
+	}
+	return pmux.PacketHandler(pktType, handler, middleware...)
+}
+
+// SetDecodeErrorHandler sets the function called when a handler registered with
+// TypedPacketHandler cannot unmarshal a packet. By default the packet is
+// reported as dropped with DropReasonMalformed
+func (pmux *PacketMux) SetDecodeErrorHandler(handler DecodeErrorHandler) {
 	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	pmux.decodeError = handler
+}
+
+// ReplacePacketHandler atomically swaps the PacketHandler and route middleware
+// registered for PacketType. Packets already being handled finish with the
+// previous PacketHandler. ErrPacketHandlerNotFound is returned when no
+// PacketHandler is registered for PacketType
+func (pmux *PacketMux) ReplacePacketHandler(pktType PacketType, packetHandler PacketHandler, middleware ...Middleware) error {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
 	if packetHandler == nil {
 		return ErrNilPacketHander
 	}
-	if pmux.m == nil {
-		pmux.m = make(map[PacketType]packetMuxEntry)
+	if _, ok := pmux.m[pktType]; !ok {
+		return ErrPacketHandlerNotFound
 	}
-	if _, ok := pmux.m[pktType]; ok {
-		return ErrPacketHandlerAlreadyExists
+	entry := packetMuxEntry{packetHandler: packetHandler, pktType: pktType, middleware: middleware}
+	entry.handler = pmux.chain(entry)
+	pmux.m[pktType] = entry
+	return nil
+}
+
+// ReplacePacketHandlerFunc atomically swaps the PacketHandlerFunc registered for PacketType
+func (pmux *PacketMux) ReplacePacketHandlerFunc(pktType PacketType, packetHandler func(packet Packet, pw PacketWriter), middleware ...Middleware) error {
+	if packetHandler == nil {
+		return ErrNilPacketHander
+	}
+	return pmux.ReplacePacketHandler(pktType, PacketHandlerFunc(packetHandler), middleware...)
+}
+
+// RemovePacketHandler unregisters the PacketHandler for PacketType. Packets of
+// that PacketType are passed to the NotFoundHandler afterwards.
+// ErrPacketHandlerNotFound is returned when no PacketHandler is registered
+func (pmux *PacketMux) RemovePacketHandler(pktType PacketType) error {
+	pmux.mu.Lock()
+	defer pmux.mu.Unlock()
+	if _, ok := pmux.m[pktType]; !ok {
+		return ErrPacketHandlerNotFound
 	}
-	pmux.m[pktType] = packetMuxEntry{packetHandler: PacketHandlerFunc(packetHandler), pktType: pktType}
-	pmux.mu.Unlock()
+	delete(pmux.m, pktType)
 	return nil
 }
 
+// Route describes a PacketType registered on a PacketMux
+type Route struct {
+	PacketType PacketType
+	// Name is the name registered with RegisterPacketTypeName
+	Name string
+	// Middleware is the number of route middleware wrapping the PacketHandler
+	Middleware int
+}
+
+// Routes returns the routes registered on the PacketMux ordered by PacketType
+func (pmux *PacketMux) Routes() []Route {
+	pmux.mu.RLock()
+	routes := make([]Route, 0, len(pmux.m))
+	for pktType, entry := range pmux.m {
+		routes = append(routes, Route{
+			PacketType: pktType,
+			Name:       pktType.String(),
+			Middleware: len(entry.middleware),
+		})
+	}
+	pmux.mu.RUnlock()
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].PacketType < routes[j].PacketType
+	})
+	return routes
+}
+
+// chain wraps the entry's PacketHandler with the route middleware and then the
+// mux middleware so that the first mux middleware added is the outermost handler
+func (pmux *PacketMux) chain(entry packetMuxEntry) PacketHandler {
+	handler := entry.packetHandler
+	for i := len(entry.middleware) - 1; i >= 0; i-- {
+		handler = entry.middleware[i](handler)
+	}
+	for i := len(pmux.middleware) - 1; i >= 0; i-- {
+		handler = pmux.middleware[i](handler)
+	}
+	return handler
+}
+
 // HandlePacket statifies the PacketHandler interface. A PacketType is expected to be
 // set by the caller. The PacketType is used to find the PacketHandler to call
 func (pmux *PacketMux) HandlePacket(packet Packet, pw PacketWriter) {
-	pktType, msg, _ := decode(packet.Msg())
+	h, msg, err := decodeMessage(packet.Msg())
+	if err == ErrChecksumMismatch {
+		packet.mon.corrupt(packet, err)
+		return
+	}
+	if err != nil {
+		packet.mon.malformed(packet, err)
+		return
+	}
+	pktType := h.pktType
+	if h.flags&flagChecksum == 0 && pmux.checksumRequired(pktType) {
+		packet.mon.corrupt(packet, ErrChecksumRequired)
+		return
+	}
+
+	handler := pmux.findPacketHandler(pktType)
+	if tracer := pmux.findTracer(); tracer != nil {
+		span := pmux.startSpan(tracer, &packet, pktType, handler != nil)
+		if binder, ok := pw.(contextBinder); ok {
+			pw = binder.withContext(packet.Context())
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				span.RecordError(fmt.Errorf("packet handler panic: %v", r))
+				span.End()
+				panic(r)
+			}
+			span.End()
+		}()
+	}
+	if handler == nil {
+		packet.mon.unknownPacketType(packet, pktType)
+		if notFound := pmux.findNotFoundHandler(); notFound != nil {
+			notFound.HandlePacket(packet, pw)
+		}
+		return
+	}
 	// update packet msg with remove pktType
 	packet.SetMsg(msg)
+	handler.HandlePacket(packet, pw)
+}
 
-	handler := pmux.findPacketHandler(pktType)
-	if handler != nil {
-		handler.HandlePacket(packet, pw)
+// startSpan starts the span for a packet of pktType and sets the packet's
+// context to carry it
+func (pmux *PacketMux) startSpan(tracer Tracer, packet *Packet, pktType PacketType, found bool) Span {
+	ctx, span := tracer.Start(packet.Context(), pktType.String())
+	packet.SetContext(ctx)
+	span.SetAttribute("hacket.packet_type", uint16(pktType))
+	span.SetAttribute("hacket.message_size", len(packet.Msg()))
+	if addr := packet.FromAddr(); addr != nil {
+		span.SetAttribute("net.peer.addr", addr.String())
+	}
+	if !found {
+		span.SetAttribute("hacket.unknown_packet_type", true)
 	}
+	return span
+}
+
+// checksumRequired reports whether packets of pktType must carry a checksum
+func (pmux *PacketMux) checksumRequired(pktType PacketType) bool {
+	pmux.mu.RLock()
+	defer pmux.mu.RUnlock()
+	_, ok := pmux.checksums[pktType]
+	return ok
+}
+
+// findDecodeErrorHandler returns the DecodeErrorHandler if one is set
+func (pmux *PacketMux) findDecodeErrorHandler() DecodeErrorHandler {
+	pmux.mu.RLock()
+	defer pmux.mu.RUnlock()
+	return pmux.decodeError
+}
+
+// findTracer returns the Tracer if one is set
+func (pmux *PacketMux) findTracer() Tracer {
+	pmux.mu.RLock()
+	defer pmux.mu.RUnlock()
+	return pmux.tracer
+}
+
+// findNotFoundHandler returns the NotFoundHandler if one is set
+func (pmux *PacketMux) findNotFoundHandler() PacketHandler {
+	pmux.mu.RLock()
+	defer pmux.mu.RUnlock()
+	return pmux.notFound.handler
 }
 
 // findPacketHandler returns a PacketHandler if the pktType is found
 func (pmux *PacketMux) findPacketHandler(pktType PacketType) PacketHandler {
 	pmux.mu.RLock()
+	defer pmux.mu.RUnlock()
 	entry, ok := pmux.m[pktType]
 	if !ok {
 		return nil
 	}
-	pmux.mu.RUnlock()
-	return entry.packetHandler
+	return entry.handler
 }
@@ -0,0 +1,195 @@
+package hacket
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingMiddleware appends name to calls before calling the next handler
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return PacketHandlerFunc(func(packet Packet, pw PacketWriter) {
+			*calls = append(*calls, name)
+			next.HandlePacket(packet, pw)
+		})
+	}
+}
+
+// recordingPacketWriter records the messages written by handlers
+type recordingPacketWriter struct {
+	msgs []PacketMessage
+}
+
+func (rpw *recordingPacketWriter) WriteTo(msg PacketMessage, addr net.Addr) (int, error) {
+	rpw.msgs = append(rpw.msgs, msg)
+	return len(msg), nil
+}
+
+func (rpw *recordingPacketWriter) WriteToContext(ctx context.Context, msg PacketMessage, addr net.Addr) (int, error) {
+	return rpw.WriteTo(msg, addr)
+}
+
+func (rpw *recordingPacketWriter) WriteReliable(ctx context.Context, msg PacketMessage, addr net.Addr) error {
+	_, err := rpw.WriteTo(msg, addr)
+	return err
+}
+
+func (rpw *recordingPacketWriter) WriteBatch(msgs []BatchMessage) (int, error) {
+	for _, m := range msgs {
+		rpw.WriteTo(m.Msg, m.Addr)
+	}
+	return len(msgs), nil
+}
+
+// newTestPacket builds a packet for pktType with body
+func newTestPacket(pktType PacketType, body string) Packet {
+	msg, _ := NewPacketMessageBuilder([]byte(body)).WithPacketType(pktType).Build()
+	return NewPacket(msg, nil, time.Now())
+}
+
+func TestPacketMuxMiddlewareOrder(t *testing.T) {
+	var calls []string
+	mux := NewPacketMux()
+	mux.Use(recordingMiddleware("mux-1", &calls))
+	err := mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		calls = append(calls, "handler")
+	}, recordingMiddleware("route-1", &calls), recordingMiddleware("route-2", &calls))
+	if err != nil {
+		t.Fatal("Error registering handler:", err)
+	}
+	// mux middleware added after registration still applies
+	mux.Use(recordingMiddleware("mux-2", &calls))
+	mux.PacketHandlerFunc(PacketType(2), func(packet Packet, pw PacketWriter) {
+		calls = append(calls, "other")
+	})
+
+	mux.HandlePacket(newTestPacket(PacketType(1), "test"), nil)
+	want := []string{"mux-1", "mux-2", "route-1", "route-2", "handler"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected calls %v, received %v", want, calls)
+	}
+
+	calls = nil
+	mux.HandlePacket(newTestPacket(PacketType(2), "test"), nil)
+	want = []string{"mux-1", "mux-2", "other"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected calls %v, received %v", want, calls)
+	}
+}
+
+func TestPacketMuxMiddlewareShortCircuit(t *testing.T) {
+	handled := false
+	deny := func(next PacketHandler) PacketHandler {
+		return PacketHandlerFunc(func(packet Packet, pw PacketWriter) {})
+	}
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		handled = true
+	}, deny)
+	mux.HandlePacket(newTestPacket(PacketType(1), "test"), nil)
+	if handled {
+		t.Error("Expected middleware to stop the packet from being handled")
+	}
+}
+
+func TestPacketMuxNotFoundHandler(t *testing.T) {
+	var calls []string
+	var unknown PacketMessage
+	mux := NewPacketMux()
+	mux.Use(recordingMiddleware("mux", &calls))
+	mux.NotFoundHandlerFunc(func(packet Packet, pw PacketWriter) {
+		unknown = packet.Msg()
+	})
+	if _, err := mux.Handler(PacketType(7)); err != ErrPacketHandlerNotFound {
+		t.Error("Expected packet handler not found error, received:", err)
+	}
+
+	packet := newTestPacket(PacketType(7), "test")
+	mux.HandlePacket(packet, nil)
+	if !reflect.DeepEqual(unknown, packet.Msg()) {
+		t.Errorf("Expected not found handler to receive %v, received %v", packet.Msg(), unknown)
+	}
+	if !reflect.DeepEqual(calls, []string{"mux"}) {
+		t.Error("Expected mux middleware to wrap the not found handler")
+	}
+
+	unknown = nil
+	mux.NotFoundHandler(nil)
+	mux.HandlePacket(packet, nil)
+	if unknown != nil {
+		t.Error("Expected removed not found handler to not be called")
+	}
+}
+
+func TestUnknownPacketTypeHandler(t *testing.T) {
+	pw := &recordingPacketWriter{}
+	mux := NewPacketMux()
+	mux.NotFoundHandler(UnknownPacketTypeHandler())
+	mux.HandlePacket(newTestPacket(PacketType(9), "test"), pw)
+	if len(pw.msgs) != 1 {
+		t.Fatalf("Expected one error reply, received %d", len(pw.msgs))
+	}
+	pe, err := ParseErrorPacket(pw.msgs[0])
+	if err != nil {
+		t.Fatal("Error parsing error packet:", err)
+	}
+	if pe.Code != ErrorCodeUnknownPacketType || pe.PacketType != PacketType(9) {
+		t.Errorf("Unexpected error packet %+v", pe)
+	}
+
+	// error packets are never replied to
+	mux.HandlePacket(NewPacket(pw.msgs[0], nil, time.Now()), pw)
+	if len(pw.msgs) != 1 {
+		t.Error("Expected no reply to an error packet")
+	}
+}
+
+func TestPacketMuxRouteManagement(t *testing.T) {
+	var handled []string
+	RegisterPacketTypeName(PacketType(21), "heartbeat")
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(21), func(packet Packet, pw PacketWriter) {
+		handled = append(handled, "v1")
+	})
+	mux.PacketHandlerFunc(PacketType(20), func(packet Packet, pw PacketWriter) {}, recordingMiddleware("route", &handled))
+
+	want := []Route{
+		{PacketType: PacketType(20), Name: "PacketType(20)", Middleware: 1},
+		{PacketType: PacketType(21), Name: "heartbeat"},
+	}
+	if routes := mux.Routes(); !reflect.DeepEqual(routes, want) {
+		t.Errorf("Expected routes %v, received %v", want, routes)
+	}
+
+	err := mux.ReplacePacketHandlerFunc(PacketType(21), func(packet Packet, pw PacketWriter) {
+		handled = append(handled, "v2")
+	})
+	if err != nil {
+		t.Fatal("Error replacing handler:", err)
+	}
+	mux.HandlePacket(newTestPacket(PacketType(21), "test"), nil)
+	if !reflect.DeepEqual(handled, []string{"v2"}) {
+		t.Errorf("Expected replaced handler to be called, called %v", handled)
+	}
+	if err := mux.ReplacePacketHandlerFunc(PacketType(22), func(packet Packet, pw PacketWriter) {}); err != ErrPacketHandlerNotFound {
+		t.Error("Expected packet handler not found error, received:", err)
+	}
+
+	if err := mux.RemovePacketHandler(PacketType(21)); err != nil {
+		t.Fatal("Error removing handler:", err)
+	}
+	if err := mux.RemovePacketHandler(PacketType(21)); err != ErrPacketHandlerNotFound {
+		t.Error("Expected packet handler not found error, received:", err)
+	}
+	handled = nil
+	mux.HandlePacket(newTestPacket(PacketType(21), "test"), nil)
+	if len(handled) != 0 {
+		t.Error("Expected removed handler to not be called")
+	}
+	if routes := mux.Routes(); len(routes) != 1 || routes[0].PacketType != PacketType(20) {
+		t.Errorf("Unexpected routes after removal %v", routes)
+	}
+}
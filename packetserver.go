@@ -2,8 +2,8 @@ package hacket
 
 import (
 	"context"
-	"log"
 	"net"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,45 +16,80 @@ func (b *atomicBool) setTrue()    { atomic.StoreInt32((*int32)(b), 1) }
 
 // PacketServer interface used to describe a packet server.
 type PacketServer interface {
+	Addr() net.Addr
 	Port() (int, error)
 	Serve(handler PacketHandler) error
 	Shutdown(ctx context.Context) error
+	Stats() Stats
 }
 
-var _ PacketServer = &udpPacketServerImpl{}
+var _ PacketServer = &packetServerImpl{}
 
 // packetServerImpl a connection less server that wraps a net.PacketConn
-type udpPacketServerImpl struct {
-	conn             *net.UDPConn
-	options          *packetOptions
-	shutdown         atomicBool
-	mu               sync.Mutex
-	concurrencyLimit chan struct{}
+type packetServerImpl struct {
+	conn     net.PacketConn
+	options  *packetOptions
+	ep       *endpoint
+	shutdown atomicBool
+	mu       sync.Mutex
+	workers  sync.WaitGroup
+	// ctx is the parent of every packet's context and is cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// newUDPPacketServer creates a Packet Server that is configured for UDP
-func newUDPPacketServer(conn *net.UDPConn, options *packetOptions) PacketServer {
-	return &udpPacketServerImpl{
-		conn:             conn,
-		options:          options,
-		concurrencyLimit: make(chan struct{}, options.ConcurrencyLimit),
+// delivery is a packet waiting to be handled by a worker along with the
+// PacketWriter the handler replies with
+type delivery struct {
+	packet Packet
+	pw     PacketWriter
+}
+
+// newPacketServer creates a Packet Server that reads from the endpoint's connection
+func newPacketServer(ep *endpoint) PacketServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &packetServerImpl{
+		conn:    ep.conn,
+		options: ep.options,
+		ep:      ep,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Addr returns the local address the server is bound to
+func (ps *packetServerImpl) Addr() net.Addr {
+	if ps.conn == nil {
+		return nil
 	}
+	return ps.conn.LocalAddr()
 }
 
 //Port returns the port
 // Can be used to find out the real port if helve is started with
-// port 0 to auto bind
-func (ps *udpPacketServerImpl) Port() (int, error) {
+// port 0 to auto bind. Networks without ports, such as unixgram,
+// return ErrNoPort
+func (ps *packetServerImpl) Port() (int, error) {
 	if ps.conn == nil {
 		return 0, ErrNilConn
 	}
-	// We made sure there's at least one UDP listener, and that one's
-	// port was applied to all the others for the dynamic bind case.
-	return ps.conn.LocalAddr().(*net.UDPAddr).Port, nil
+	udpAddr, ok := ps.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return 0, ErrNoPort
+	}
+	return udpAddr.Port, nil
 }
 
-// Serve starts a Packet server
-func (ps *udpPacketServerImpl) Serve(handler PacketHandler) error {
+// Serve starts a Packet server. A fixed pool of workers sized by the
+// concurrency limit handles packets while Serve reads from the connection.
+// When a batch size is configured UDP connections read several datagrams
+// per system call.
+// Each datagram is read into a reusable buffer and copied into a pooled
+// buffer sized to the datagram, which is released once the handler returns.
+// Reading pauses while every worker is busy. Serve returns
+// ErrPacketServiceShutdown once the server is shut down, or the read error
+// when the connection is closed by something other than Shutdown.
+func (ps *packetServerImpl) Serve(handler PacketHandler) error {
 	if ps.shutdown.isSet() {
 		return ErrPacketServiceShutdown
 	} else if handler == nil {
@@ -62,76 +97,170 @@ func (ps *udpPacketServerImpl) Serve(handler PacketHandler) error {
 	} else if ps.conn == nil {
 		return ErrMissingPacketConn
 	}
+
+	ps.mu.Lock()
+	if ps.shutdown.isSet() {
+		ps.mu.Unlock()
+		return ErrPacketServiceShutdown
+	}
+	deliveries := ps.newDispatcher(handler)
+	ps.mu.Unlock()
+	// Stop the workers once reading stops
+	defer deliveries.close()
+
+	if ps.ep.batch != nil && ps.options.BatchSize > 1 {
+		return ps.serveBatch(deliveries)
+	}
+
+	buf := make([]byte, udpPacketBufSize)
 	// Continuously listen/process packets
 	for {
-		// If at concurrency limit do not try to read from connection yet
-		ps.concurrencyLimit <- struct{}{}
-
 		if ps.shutdown.isSet() {
-			<-ps.concurrencyLimit
 			return ErrPacketServiceShutdown
 		}
 
-		if ps.options.ReadDeadline > 0 {
-			deadline := time.Now().Add(ps.options.ReadDeadline)
-			if err := ps.conn.SetReadDeadline(deadline); err != nil {
-				log.Println(err)
-			}
-		}
-		buf := make([]byte, udpPacketBufSize)
+		ps.setReadDeadline()
 		n, rAddr, err := ps.conn.ReadFrom(buf) // blocks until receive
 		if err != nil {
-			// log.Println("Error reading from udp socket", err)
-			<-ps.concurrencyLimit
-
 			if ps.shutdown.isSet() {
 				return ErrPacketServiceShutdown
 			}
+			if ps.ep.mon.readError(err) {
+				return err
+			}
 			continue
 		}
+		ps.receive(buf[:n], rAddr, time.Now(), deliveries)
+	}
+}
 
-		ts := time.Now()
-		// must be greater than zero to be considered a validate packet
-		if n < 1 {
-			// log.Println("Invalid packet received, packet size must be greater than zero")
-			<-ps.concurrencyLimit
-			continue
+// setReadDeadline applies the configured read deadline before reading
+func (ps *packetServerImpl) setReadDeadline() {
+	if ps.options.ReadDeadline > 0 {
+		deadline := time.Now().Add(ps.options.ReadDeadline)
+		if err := ps.conn.SetReadDeadline(deadline); err != nil {
+			ps.ep.mon.logger.Log(LevelError, "set read deadline failed", "err", err)
 		}
-		go func() {
-			// Form a packet and handle through a registered handler function
-			handler.HandlePacket(NewPacket(buf[:n], rAddr, ts), &hacketPacketWriter{ps.conn, ps.options})
-			<-ps.concurrencyLimit
+	}
+}
+
+// receive copies a datagram into a pooled buffer, processes any internal
+// frames and hands the packet to a worker. Reading pauses until a worker is free
+func (ps *packetServerImpl) receive(b []byte, rAddr net.Addr, ts time.Time, deliveries dispatcher) {
+	ps.ep.mon.received(len(b))
+	// must be greater than zero to be considered a validate packet
+	if len(b) < 1 {
+		ps.ep.mon.logger.Log(LevelDebug, "discarded zero length packet", "from", rAddr)
+		return
+	}
+	pb := getBuffer(b)
+	// Process any internal frames before handing the packet to a worker
+	packet, ok := ps.ep.open(Packet{msg: pb.b, fromAddr: rAddr, timestamp: ts, buf: pb, mon: ps.ep.mon, ctx: ps.ctx})
+	if !ok {
+		packet.Release()
+		return
+	}
+	packet, pw, ok := ps.ep.ingress(packet)
+	if !ok {
+		packet.Release()
+		return
+	}
+	deliveries.dispatch(delivery{packet: packet, pw: pw})
+}
+
+// newDispatcher starts the workers that handle packets for the configured dispatch mode
+func (ps *packetServerImpl) newDispatcher(handler PacketHandler) dispatcher {
+	handle := func(d delivery) {
+		// Handle through a registered handler function
+		start := ps.ep.mon.handlerStarted()
+		if ps.options.HandlerTimeout > 0 {
+			ctx, cancel := context.WithTimeout(d.packet.Context(), ps.options.HandlerTimeout)
+			defer cancel()
+			d.packet.ctx = ctx
+		}
+		defer func() {
+			// A panicking handler must not take down the worker or the process
+			if r := recover(); r != nil {
+				ps.ep.mon.handlerPanic(d.packet, r, debug.Stack())
+				if ps.options.PanicReply {
+					ps.replyPanic(d)
+				}
+			}
+			ps.ep.mon.handlerFinished(start)
+			d.packet.Release()
 		}()
+		handler.HandlePacket(d.packet, d.pw)
 	}
+	if ps.options.PeerQueueSize > 0 {
+		return newOrderedDispatcher(ps.options.ConcurrencyLimit, ps.options.PeerQueueSize, ps.options.PeerQueuePolicy, &ps.ep.mon.drops, &ps.workers, handle)
+	}
+	if ps.options.Overload || len(ps.options.Priorities) > 0 || ps.options.ReservedConcurrency > 0 {
+		return newQueueDispatcher(ps.options.ConcurrencyLimit, ps.options.ReservedConcurrency, ps.options.QueueSize, ps.options.Priorities,
+			ps.options.OverloadPolicy, ps.options.ShedPacketTypes, &ps.ep.mon.drops, &ps.workers, handle)
+	}
+	return newPoolDispatcher(ps.options.ConcurrencyLimit, &ps.workers, handle)
+}
+
+// replyPanic tells the sender that the handler for its packet panicked. Error
+// packets are never replied to so two peers cannot exchange errors forever
+func (ps *packetServerImpl) replyPanic(d delivery) {
+	if d.pw == nil || IsErrorPacket(d.packet.Msg()) {
+		return
+	}
+	pktType, _, err := decode(d.packet.Msg())
+	if err != nil {
+		return
+	}
+	msg, err := NewErrorPacketMessage(ErrorCodeHandlerPanic, pktType, "")
+	if err != nil {
+		return
+	}
+	if _, err := d.pw.WriteTo(msg, d.packet.FromAddr()); err != nil {
+		ps.ep.mon.logger.Log(LevelWarn, "panic reply failed", "to", d.packet.FromAddr(), "err", err)
+	}
+}
+
+// Stats returns a snapshot of the packets sent and received on the server's connection
+func (ps *packetServerImpl) Stats() Stats {
+	return ps.ep.mon.snapshot()
 }
 
 // Shutdown will wait for read messages to be finished processing and
-// sets shutdown so that new messages will not be read
+// sets shutdown so that new messages will not be read. The context of
+// every packet being handled is cancelled.
 // Can end early by closing context.
-func (ps *udpPacketServerImpl) Shutdown(ctx context.Context) error {
+func (ps *packetServerImpl) Shutdown(ctx context.Context) error {
 	// Mark server as shutdown
+	ps.mu.Lock()
 	ps.shutdown.setTrue()
+	ps.mu.Unlock()
+
+	// Signal handlers that are still running to stop
+	ps.cancel()
+
+	// Fail calls that are waiting on a reply
+	ps.ep.calls.close()
 
 	// Close connection to stop reading new messages
 	ps.conn.Close()
 
 	// Wait for handlers to finish or context to be done
+	var err error
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		err = ctx.Err()
 	case <-ps.waitForHandlers():
-		return nil
 	}
+	ps.ep.mon.shutdown(err)
+	return err
 }
 
-// waitForHandlers pushes to the concurrency limit channel until
-// full to ensure that no more handlers are processing
-func (ps *udpPacketServerImpl) waitForHandlers() <-chan struct{} {
+// waitForHandlers waits for every worker to finish handling the packets it
+// has already received
+func (ps *packetServerImpl) waitForHandlers() <-chan struct{} {
 	handlersDone := make(chan struct{})
 	go func() {
-		for i := uint32(0); i < ps.options.ConcurrencyLimit; i++ {
-			ps.concurrencyLimit <- struct{}{}
-		}
+		ps.workers.Wait()
 		close(handlersDone)
 	}()
 	return handlersDone
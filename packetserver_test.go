@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -101,7 +102,201 @@ func TestShutdownContext(t *testing.T) {
 	wg.Wait()
 }
 
+type contextKey struct{}
+
+func TestPacketContext(t *testing.T) {
+	server, client, err := New("udp", "127.0.0.1:0", WithConcurrencyLimit(2), WithHandlerTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	const timeoutType, shutdownType = PacketType(1), PacketType(2)
+	errs := make(chan error, 2)
+	values := make(chan interface{}, 2)
+	started := make(chan struct{})
+	mux := NewPacketMux()
+	mux.Use(func(next PacketHandler) PacketHandler {
+		return PacketHandlerFunc(func(packet Packet, pw PacketWriter) {
+			packet.SetContext(context.WithValue(packet.Context(), contextKey{}, "value"))
+			next.HandlePacket(packet, pw)
+		})
+	})
+	mux.PacketHandlerFunc(timeoutType, func(packet Packet, pw PacketWriter) {
+		values <- packet.Context().Value(contextKey{})
+		<-packet.Context().Done()
+		errs <- packet.Context().Err()
+	})
+	go server.Serve(mux)
+
+	msg, _ := NewPacketMessageBuilder([]byte{1}).WithPacketType(timeoutType).Build()
+	client.WriteTo(msg, server.Addr())
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Error("Expected deadline exceeded got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for handler timeout")
+	}
+	if value := <-values; value != "value" {
+		t.Error("Expected middleware value got", value)
+	}
+
+	// Shutdown cancels packets that are still being handled
+	server2, client2, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	mux2 := NewPacketMux()
+	mux2.PacketHandlerFunc(shutdownType, func(packet Packet, pw PacketWriter) {
+		close(started)
+		<-packet.Context().Done()
+		errs <- packet.Context().Err()
+	})
+	go server2.Serve(mux2)
+	msg, _ = NewPacketMessageBuilder([]byte{1}).WithPacketType(shutdownType).Build()
+	client2.WriteTo(msg, server2.Addr())
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for handler to start")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server2.Shutdown(ctx); err != nil {
+		t.Fatal("Expected handler to return on shutdown got", err)
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Error("Expected canceled got", err)
+	}
+	server.Shutdown(ctx)
+}
+
 // Handler that takes 1 second to process message
 func delayHandler(packet Packet, pw PacketWriter) {
 	time.Sleep(time.Second)
 }
+
+// benchPacketConn is a net.PacketConn that returns the same datagram from
+// every read until it is closed
+type benchPacketConn struct {
+	msg    []byte
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newBenchPacketConn(msg []byte) *benchPacketConn {
+	return &benchPacketConn{
+		msg:    msg,
+		addr:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000},
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *benchPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, ErrPacketServiceShutdown
+	default:
+	}
+	return copy(b, c.msg), c.addr, nil
+}
+
+func (c *benchPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) { return len(b), nil }
+func (c *benchPacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+func (c *benchPacketConn) LocalAddr() net.Addr                { return c.addr }
+func (c *benchPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *benchPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *benchPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func benchmarkServe(b *testing.B, size int, concurrency uint32) {
+	msg, _ := NewPacketMessageBuilder(make([]byte, size)).WithPacketType(PacketType(1)).Build()
+	server, _, err := NewFromConn(newBenchPacketConn(msg), WithConcurrencyLimit(concurrency))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var handled int64
+	done := make(chan struct{})
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(PacketType(1), func(packet Packet, pw PacketWriter) {
+		if atomic.AddInt64(&handled, 1) == int64(b.N) {
+			close(done)
+		}
+	})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	go server.Serve(mux)
+	<-done
+	b.StopTimer()
+	server.Shutdown(context.Background())
+}
+
+func BenchmarkServe64B(b *testing.B)           { benchmarkServe(b, 64, 1) }
+func BenchmarkServe1KB(b *testing.B)           { benchmarkServe(b, 1024, 1) }
+func BenchmarkServe1KBConcurrent(b *testing.B) { benchmarkServe(b, 1024, 8) }
+
+func TestHandlerPanicRecovery(t *testing.T) {
+	observer := &panicObserver{panics: make(chan []byte, 1)}
+	peer, _, err := New("udp", "127.0.0.1:0", WithPanicReply(), WithObserver(observer))
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	const panicType, okType = PacketType(1), PacketType(2)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(panicType, func(packet Packet, pw PacketWriter) {
+		panic("boom")
+	})
+	mux.PacketHandlerFunc(okType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+	})
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, _ := NewPacketMessageBuilder([]byte("panic")).WithPacketType(panicType).Build()
+	_, err = client.(Caller).Call(ctx, msg, peer.Addr())
+	perr, ok := err.(*PacketError)
+	if !ok || perr.Code != ErrorCodeHandlerPanic || perr.PacketType != panicType {
+		t.Fatal("Expected handler panic error packet got", err)
+	}
+	select {
+	case stack := <-observer.panics:
+		if len(stack) == 0 {
+			t.Error("Expected a stack trace")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for OnHandlerPanic")
+	}
+
+	// The worker is released so the next packet is handled
+	msg, _ = NewPacketMessageBuilder([]byte("ok")).WithPacketType(okType).Build()
+	reply, err := client.(Caller).Call(ctx, msg, peer.Addr())
+	if err != nil {
+		t.Fatal("Expected reply after panic got", err)
+	}
+	reply.Release()
+	if stats := peer.Stats(); stats.HandlerPanics != 1 || stats.InFlight != 0 {
+		t.Errorf("Expected 1 panic and nothing in flight got %d and %d", stats.HandlerPanics, stats.InFlight)
+	}
+}
+
+type panicObserver struct {
+	NopObserver
+	panics chan []byte
+}
+
+func (po *panicObserver) OnHandlerPanic(packet Packet, value interface{}, stack []byte) {
+	po.panics <- stack
+}
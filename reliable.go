@@ -0,0 +1,229 @@
+package hacket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// reliableFrameHeaderSize is the size of the frame type, session ID and
+	// sequence number prepended to reliable messages
+	reliableFrameHeaderSize = frameHeaderSize + 8 + 8
+	// ackFrameSize is the size of an acknowledgement, which echoes the session
+	// ID and sequence number of the message it acknowledges
+	ackFrameSize = frameHeaderSize + 8 + 8
+	// maxReliablePeers bounds the number of peers duplicate detection is tracked for
+	maxReliablePeers = 4096
+)
+
+// reliablePeer tracks the reliable messages received from a single peer session
+type reliablePeer struct {
+	session  uint64
+	window   slidingWindow
+	lastSeen time.Time
+}
+
+// pendingKey identifies a reliable message waiting on acknowledgement. Only
+// the peer it was sent to can acknowledge it
+type pendingKey struct {
+	seq  uint64
+	addr string
+}
+
+// reliableState tracks reliable messages waiting on acknowledgement and the
+// reliable messages received from peers. The session ID is random so that
+// acknowledgements, which must echo it, cannot be forged by hosts that do not
+// see the messages being acknowledged
+type reliableState struct {
+	session uint64
+
+	mu      sync.Mutex
+	lastSeq uint64
+	pending map[pendingKey]chan struct{}
+	peers   map[string]*reliablePeer
+}
+
+func newReliableState() (*reliableState, error) {
+	var session [8]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, err
+	}
+	return &reliableState{
+		session: binary.BigEndian.Uint64(session[:]),
+		pending: make(map[pendingKey]chan struct{}),
+		peers:   make(map[string]*reliablePeer),
+	}, nil
+}
+
+// addrKey returns the key used to track addr
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// register allocates a sequence number for a message to addr and the channel
+// closed when it is acknowledged
+func (rs *reliableState) register(addr net.Addr) (pendingKey, <-chan struct{}) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.lastSeq++
+	key := pendingKey{seq: rs.lastSeq, addr: addrKey(addr)}
+	acked := make(chan struct{})
+	rs.pending[key] = acked
+	return key, acked
+}
+
+// cancel stops waiting for key to be acknowledged
+func (rs *reliableState) cancel(key pendingKey) {
+	rs.mu.Lock()
+	delete(rs.pending, key)
+	rs.mu.Unlock()
+}
+
+// ack marks seq as acknowledged by addr. Acknowledgements for another session,
+// from another address and duplicate acknowledgements are ignored
+func (rs *reliableState) ack(session uint64, seq uint64, addr net.Addr) {
+	if session != rs.session {
+		return
+	}
+	key := pendingKey{seq: seq, addr: addrKey(addr)}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if acked, ok := rs.pending[key]; ok {
+		close(acked)
+		delete(rs.pending, key)
+	}
+}
+
+// accept reports whether a reliable message from addr has not been seen before
+func (rs *reliableState) accept(addr net.Addr, session uint64, seq uint64, ttl time.Duration) bool {
+	key := addrKey(addr)
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	peer, ok := rs.peers[key]
+	if !ok || peer.session != session {
+		if !ok && len(rs.peers) >= maxReliablePeers {
+			rs.prune(now, ttl)
+		}
+		peer = &reliablePeer{session: session}
+		rs.peers[key] = peer
+	}
+	peer.lastSeen = now
+	return peer.window.check(seq)
+}
+
+// prune removes peers that have not sent a reliable message within ttl. When
+// every peer is active the least recently seen peer is removed
+func (rs *reliableState) prune(now time.Time, ttl time.Duration) {
+	var oldestKey string
+	var oldest time.Time
+	for key, peer := range rs.peers {
+		if now.Sub(peer.lastSeen) > ttl {
+			delete(rs.peers, key)
+			continue
+		}
+		if oldest.IsZero() || peer.lastSeen.Before(oldest) {
+			oldestKey, oldest = key, peer.lastSeen
+		}
+	}
+	if len(rs.peers) >= maxReliablePeers {
+		delete(rs.peers, oldestKey)
+	}
+}
+
+// encodeReliableFrame prepends a reliable frame header to msg
+func encodeReliableFrame(session uint64, seq uint64, msg []byte) (PacketMessage, error) {
+	if msg == nil {
+		return nil, ErrNilByteSlice
+	}
+	frame := make([]byte, reliableFrameHeaderSize+len(msg))
+	putFrameHeader(frame, frameReliable)
+	binary.BigEndian.PutUint64(frame[frameHeaderSize:frameHeaderSize+8], session)
+	binary.BigEndian.PutUint64(frame[frameHeaderSize+8:reliableFrameHeaderSize], seq)
+	copy(frame[reliableFrameHeaderSize:], msg)
+	return frame, nil
+}
+
+// decodeReliableFrame returns the session ID, sequence number and message wrapped by a reliable frame
+func decodeReliableFrame(b []byte) (uint64, uint64, PacketMessage, error) {
+	if len(b) < reliableFrameHeaderSize {
+		return 0, 0, nil, ErrShortPacket
+	}
+	session := binary.BigEndian.Uint64(b[frameHeaderSize : frameHeaderSize+8])
+	seq := binary.BigEndian.Uint64(b[frameHeaderSize+8 : reliableFrameHeaderSize])
+	return session, seq, b[reliableFrameHeaderSize:], nil
+}
+
+// encodeAckFrame creates the acknowledgement for seq of the sender's session
+func encodeAckFrame(session uint64, seq uint64) PacketMessage {
+	frame := make([]byte, ackFrameSize)
+	putFrameHeader(frame, frameAck)
+	binary.BigEndian.PutUint64(frame[frameHeaderSize:frameHeaderSize+8], session)
+	binary.BigEndian.PutUint64(frame[frameHeaderSize+8:ackFrameSize], seq)
+	return frame
+}
+
+// decodeAckFrame returns the session ID and sequence number being acknowledged
+func decodeAckFrame(b []byte) (uint64, uint64, error) {
+	if len(b) < ackFrameSize {
+		return 0, 0, ErrShortPacket
+	}
+	session := binary.BigEndian.Uint64(b[frameHeaderSize : frameHeaderSize+8])
+	seq := binary.BigEndian.Uint64(b[frameHeaderSize+8 : ackFrameSize])
+	return session, seq, nil
+}
+
+// writeReliable writes msg to addr and retransmits it with exponential backoff
+// until it is acknowledged, ctx is done or the retransmission limit is reached
+func (ep *endpoint) writeReliable(ctx context.Context, msg PacketMessage, addr net.Addr) error {
+	key, acked := ep.reliable.register(addr)
+	defer ep.reliable.cancel(key)
+	frame, err := encodeReliableFrame(ep.reliable.session, key.seq, msg)
+	if err != nil {
+		return err
+	}
+	frame, _ = traced(ctx, frame)
+	timeout := ep.options.RetransmitTimeout
+	for attempt := 0; attempt < ep.options.MaxTransmissions; attempt++ {
+		if _, err := ep.writeTo(frame, addr); err != nil {
+			return err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-acked:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		timeout *= 2
+		if ep.options.MaxRetransmitTimeout > 0 && timeout > ep.options.MaxRetransmitTimeout {
+			timeout = ep.options.MaxRetransmitTimeout
+		}
+	}
+	return ErrDeliveryFailed
+}
+
+// duplicateTTL is how long a peer's reliable messages are tracked for
+// duplicates after it was last seen. It covers the full retransmission schedule
+func (ep *endpoint) duplicateTTL() time.Duration {
+	ttl := time.Duration(0)
+	timeout := ep.options.RetransmitTimeout
+	for attempt := 0; attempt < ep.options.MaxTransmissions; attempt++ {
+		ttl += timeout
+		timeout *= 2
+		if ep.options.MaxRetransmitTimeout > 0 && timeout > ep.options.MaxRetransmitTimeout {
+			timeout = ep.options.MaxRetransmitTimeout
+		}
+	}
+	return ttl * 2
+}
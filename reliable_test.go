@@ -0,0 +1,160 @@
+package hacket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elewis787/hacket/internal/mocks"
+)
+
+const (
+	controlType PacketType = iota + 1
+	bulkType
+)
+
+// newLossyServer creates a server over a loopback connection that drops
+// written packets when drop returns true
+func newLossyServer(t *testing.T, drop func(b []byte, addr net.Addr) bool, options ...Options) (PacketServer, PacketClient) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating connection:", err)
+	}
+	server, client, err := NewFromConn(mocks.NewLossyPacketConn(conn, drop), options...)
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	return server, client
+}
+
+func TestWriteReliableRetransmits(t *testing.T) {
+	// drop the first two transmissions and the first acknowledgement
+	var reliableWrites, ackWrites int32
+	sender, client := newLossyServer(t, func(b []byte, addr net.Addr) bool {
+		ft, _ := frameOf(b)
+		return ft == frameReliable && atomic.AddInt32(&reliableWrites, 1) <= 2
+	}, WithRetransmitTimeout(time.Millisecond*10, time.Millisecond*40))
+	defer sender.Shutdown(context.Background())
+	go sender.Serve(NewPacketMux())
+
+	receiver, _ := newLossyServer(t, func(b []byte, addr net.Addr) bool {
+		ft, _ := frameOf(b)
+		return ft == frameAck && atomic.AddInt32(&ackWrites, 1) <= 1
+	})
+	defer receiver.Shutdown(context.Background())
+
+	var mu sync.Mutex
+	var control, bulk int
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(controlType, func(packet Packet, pw PacketWriter) {
+		mu.Lock()
+		control++
+		mu.Unlock()
+	})
+	mux.PacketHandlerFunc(bulkType, func(packet Packet, pw PacketWriter) {
+		mu.Lock()
+		bulk++
+		mu.Unlock()
+	})
+	go receiver.Serve(mux)
+
+	msg, _ := NewPacketMessageBuilder([]byte("config")).WithPacketType(controlType).Build()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.(ReliableWriter).WriteReliable(ctx, msg, receiver.Addr()); err != nil {
+		t.Fatal("Error writing reliable message:", err)
+	}
+	// unreliable packet types share the same socket
+	bulkMsg, _ := NewPacketMessageBuilder([]byte("data")).WithPacketType(bulkType).Build()
+	if _, err := client.WriteTo(bulkMsg, receiver.Addr()); err != nil {
+		t.Fatal("Error writing message:", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if control != 1 {
+		t.Errorf("Expected reliable message to be handled once, handled %d times", control)
+	}
+	if bulk != 1 {
+		t.Errorf("Expected unreliable message to be handled once, handled %d times", bulk)
+	}
+	if writes := atomic.LoadInt32(&reliableWrites); writes < 4 {
+		t.Errorf("Expected at least 4 transmissions, sent %d", writes)
+	}
+}
+
+func TestWriteReliableDeliveryFailed(t *testing.T) {
+	var writes int32
+	sender, client := newLossyServer(t, func(b []byte, addr net.Addr) bool {
+		atomic.AddInt32(&writes, 1)
+		return true
+	}, WithRetransmitTimeout(time.Millisecond, time.Millisecond*4), WithMaxTransmissions(3))
+	defer sender.Shutdown(context.Background())
+	go sender.Serve(NewPacketMux())
+
+	msg, _ := NewPacketMessageBuilder([]byte("lost")).WithPacketType(controlType).Build()
+	if err := client.(ReliableWriter).WriteReliable(context.Background(), msg, sender.Addr()); err != ErrDeliveryFailed {
+		t.Fatal("Expected delivery failed error, received:", err)
+	}
+	if n := atomic.LoadInt32(&writes); n != 3 {
+		t.Errorf("Expected 3 transmissions, sent %d", n)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	var sw slidingWindow
+	testcases := []struct {
+		seq  uint64
+		want bool
+	}{
+		{seq: 0, want: false},
+		{seq: 1, want: true},
+		{seq: 1, want: false},
+		{seq: 3, want: true},
+		{seq: 2, want: true},
+		{seq: 3, want: false},
+		{seq: 2000, want: true},
+		{seq: 2, want: false},
+		{seq: 1990, want: true},
+		{seq: 1990, want: false},
+		{seq: 2000 - windowSize, want: false},
+	}
+	for _, tt := range testcases {
+		if got := sw.check(tt.seq); got != tt.want {
+			t.Errorf("check(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestReliableAckAuthenticated(t *testing.T) {
+	rs, err := newReliableState()
+	if err != nil {
+		t.Fatal("Error creating reliable state:", err)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	spoofer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001}
+	key, acked := rs.register(peer)
+
+	session, seq, err := decodeAckFrame(encodeAckFrame(rs.session+1, key.seq))
+	if err != nil {
+		t.Fatal("Error decoding ack:", err)
+	}
+	rs.ack(session, seq, peer)
+	rs.ack(rs.session, key.seq, spoofer)
+	select {
+	case <-acked:
+		t.Fatal("Expected acknowledgements for another session or address to be ignored")
+	default:
+	}
+	rs.ack(rs.session, key.seq, peer)
+	select {
+	case <-acked:
+	default:
+		t.Error("Expected acknowledgement from the peer to be accepted")
+	}
+}
@@ -0,0 +1,122 @@
+package hacket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replayHeaderSize is the size of the session ID, counter and timestamp
+	// sealed with every message when a Keyring is configured
+	replayHeaderSize = 8 + 8 + 8
+	// maxReplaySessions bounds the number of peer sessions tracked for replays
+	maxReplaySessions = 4096
+)
+
+// replaySession tracks the counters received from a single peer session
+type replaySession struct {
+	window   slidingWindow
+	lastSeen time.Time
+	// newest is the latest time a message accepted from the session was sealed
+	newest time.Time
+}
+
+// replayState stamps sealed messages with a session ID, a counter that
+// increases with every message and the time the message was sealed, and
+// rejects received messages whose counter was already seen or that are too old.
+// The header is encrypted and authenticated with the message so it cannot be
+// forged without the key.
+//
+// Sessions are forgotten once every message accepted from them was sealed more
+// than the maximum age ago, after which any replay of those messages is rejected
+// as too old. Peers are expected to have loosely synchronised clocks
+type replayState struct {
+	session uint64
+	counter uint64
+
+	mu       sync.Mutex
+	sessions map[uint64]*replaySession
+}
+
+func newReplayState() (*replayState, error) {
+	var session [8]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, err
+	}
+	return &replayState{
+		session:  binary.BigEndian.Uint64(session[:]),
+		sessions: make(map[uint64]*replaySession),
+	}, nil
+}
+
+// next writes the replay header for the next message sealed at now to b
+func (rs *replayState) next(b []byte, now time.Time) {
+	binary.BigEndian.PutUint64(b[0:8], rs.session)
+	binary.BigEndian.PutUint64(b[8:16], atomic.AddUint64(&rs.counter, 1))
+	binary.BigEndian.PutUint64(b[16:replayHeaderSize], uint64(now.UnixNano()))
+}
+
+// accept checks the replay header at the start of b for a message received at
+// now and returns the message that follows it. Messages sealed more than
+// maxAge before or after now are rejected, a maxAge of zero accepts any time
+func (rs *replayState) accept(b []byte, now time.Time, maxAge time.Duration) (PacketMessage, DropReason, error) {
+	if len(b) < replayHeaderSize {
+		return nil, DropReasonMalformed, ErrShortPacket
+	}
+	session := binary.BigEndian.Uint64(b[0:8])
+	counter := binary.BigEndian.Uint64(b[8:16])
+	sealed := time.Unix(0, int64(binary.BigEndian.Uint64(b[16:replayHeaderSize])))
+	if maxAge > 0 {
+		if age := now.Sub(sealed); age > maxAge || age < -maxAge {
+			return nil, DropReasonStale, ErrStalePacket
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s, ok := rs.sessions[session]
+	if !ok {
+		if len(rs.sessions) >= maxReplaySessions && !rs.prune(now, maxAge) {
+			// forgetting an active session would let its messages be replayed
+			return nil, DropReasonReplay, ErrTooManySessions
+		}
+		s = &replaySession{}
+		rs.sessions[session] = s
+	}
+	if !s.window.check(counter) {
+		return nil, DropReasonReplay, ErrReplayedPacket
+	}
+	s.lastSeen = now
+	if sealed.After(s.newest) {
+		s.newest = sealed
+	}
+	return b[replayHeaderSize:], 0, nil
+}
+
+// prune removes sessions whose newest message was sealed more than maxAge ago
+// and reports whether any were removed. Every message accepted from a removed
+// session is rejected as stale, even when the sender's clock runs ahead. Without
+// a maximum age the least recently seen session is removed instead
+func (rs *replayState) prune(now time.Time, maxAge time.Duration) bool {
+	var oldestSession uint64
+	var oldest time.Time
+	pruned := false
+	for session, s := range rs.sessions {
+		if maxAge > 0 && now.Sub(s.newest) > maxAge {
+			delete(rs.sessions, session)
+			pruned = true
+			continue
+		}
+		if oldest.IsZero() || s.lastSeen.Before(oldest) {
+			oldestSession, oldest = session, s.lastSeen
+		}
+	}
+	if !pruned && maxAge <= 0 && !oldest.IsZero() {
+		delete(rs.sessions, oldestSession)
+		pruned = true
+	}
+	return pruned
+}
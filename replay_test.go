@@ -0,0 +1,122 @@
+package hacket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestReplayState(t *testing.T) *replayState {
+	rs, err := newReplayState()
+	if err != nil {
+		t.Fatal("Error creating replay state:", err)
+	}
+	return rs
+}
+
+func TestReplayState(t *testing.T) {
+	sender, receiver := newTestReplayState(t), newTestReplayState(t)
+	now := time.Now()
+	seal := func(at time.Time) []byte {
+		b := make([]byte, replayHeaderSize, replayHeaderSize+4)
+		sender.next(b, at)
+		return append(b, "body"...)
+	}
+	first, second := seal(now), seal(now)
+
+	if body, _, err := receiver.accept(second, now, time.Minute); err != nil || string(body) != "body" {
+		t.Fatalf("Expected body got %q %v", body, err)
+	}
+	// out of order within the window is accepted once
+	if _, _, err := receiver.accept(first, now, time.Minute); err != nil {
+		t.Error("Expected out of order message to be accepted got", err)
+	}
+	if _, reason, err := receiver.accept(first, now, time.Minute); err != ErrReplayedPacket || reason != DropReasonReplay {
+		t.Error("Expected ErrReplayedPacket got", err, reason)
+	}
+	if _, reason, err := receiver.accept(seal(now.Add(-time.Hour)), now, time.Minute); err != ErrStalePacket || reason != DropReasonStale {
+		t.Error("Expected ErrStalePacket got", err, reason)
+	}
+	if _, _, err := receiver.accept(seal(now.Add(-time.Hour)), now, 0); err != nil {
+		t.Error("Expected age check to be disabled got", err)
+	}
+	if _, _, err := receiver.accept(first[:replayHeaderSize-1], now, time.Minute); err != ErrShortPacket {
+		t.Error("Expected ErrShortPacket got", err)
+	}
+}
+
+func TestReplayPruneBySealedTime(t *testing.T) {
+	const maxAge = time.Minute
+	sender, receiver := newTestReplayState(t), newTestReplayState(t)
+	now := time.Now()
+	// the sender's clock runs ahead so the message stays fresh after its session
+	// has been idle for longer than maxAge
+	header := make([]byte, replayHeaderSize)
+	sender.next(header, now.Add(maxAge))
+	if _, _, err := receiver.accept(header, now, maxAge); err != nil {
+		t.Fatal("Expected message to be accepted got", err)
+	}
+	later := now.Add(maxAge + time.Second)
+	if receiver.prune(later, maxAge) {
+		t.Fatal("Expected session with a fresh message not to be pruned")
+	}
+	if _, _, err := receiver.accept(header, later, maxAge); err != ErrReplayedPacket {
+		t.Error("Expected ErrReplayedPacket got", err)
+	}
+	if !receiver.prune(now.Add(2*maxAge+time.Second), maxAge) {
+		t.Error("Expected session to be pruned once its newest message is stale")
+	}
+}
+
+func TestSealedReplayDropped(t *testing.T) {
+	keys := NewKeyring()
+	keys.AddKey(1, CipherAES256GCM, testKey(1))
+	dropped := make(chan DropReason, 1)
+	server, _, err := New("udp", "127.0.0.1:0", WithKeyring(keys), WithDropHandler(func(packet Packet, reason DropReason) {
+		dropped <- reason
+	}))
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	handled := make(chan struct{}, 2)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(1, func(packet Packet, pw PacketWriter) {
+		handled <- struct{}{}
+	})
+	go server.Serve(mux)
+
+	// capture a sealed datagram and send it twice from a plaintext connection
+	sender := &endpoint{options: &packetOptions{Keyring: keys}, replay: newTestReplayState(t)}
+	msg, _ := NewPacketMessageBuilder([]byte("once")).WithPacketType(1).Build()
+	sealed, err := sender.seal(msg, nil)
+	if err != nil {
+		t.Fatal("Error sealing:", err)
+	}
+	attacker, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating client:", err)
+	}
+	defer attacker.Shutdown(context.Background())
+	client.WriteTo(sealed, server.Addr())
+	client.WriteTo(sealed, server.Addr())
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the first delivery")
+	}
+	select {
+	case reason := <-dropped:
+		if reason != DropReasonReplay {
+			t.Error("Expected replay drop got", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the replay to be dropped")
+	}
+	select {
+	case <-handled:
+		t.Error("Expected the replay not to be handled")
+	default:
+	}
+}
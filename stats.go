@@ -0,0 +1,327 @@
+package hacket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the handler latency histogram buckets
+var latencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats is a snapshot of the activity of a PacketServer and the PacketClient
+// and PacketWriters that share its connection
+type Stats struct {
+	// PacketsReceived number of datagrams read from the connection
+	PacketsReceived uint64
+	// BytesReceived number of bytes read from the connection
+	BytesReceived uint64
+	// PacketsSent number of datagrams written to the connection
+	PacketsSent uint64
+	// BytesSent number of bytes written to the connection
+	BytesSent uint64
+	// ReadErrors number of failed reads from the connection
+	ReadErrors uint64
+	// WriteErrors number of failed writes to the connection
+	WriteErrors uint64
+	// ZeroLengthPackets number of empty datagrams discarded
+	ZeroLengthPackets uint64
+	// UnknownPacketTypes number of packets a PacketMux had no PacketHandler for
+	UnknownPacketTypes uint64
+	// PacketsHandled number of packets handed to the PacketHandler, including those that panicked
+	PacketsHandled uint64
+	// HandlerPanics number of packets whose PacketHandler panicked
+	HandlerPanics uint64
+	// InFlight number of packets currently being handled
+	InFlight int64
+	// Dropped number of packets discarded before being handled by DropReason
+	Dropped map[DropReason]uint64
+	// HandlerLatency distribution of the time taken by the PacketHandler
+	HandlerLatency Histogram
+}
+
+// Histogram is a snapshot of a distribution of durations
+type Histogram struct {
+	// Bounds are the inclusive upper bounds of each bucket
+	Bounds []time.Duration
+	// Counts is the number of observations in each bucket. The final count,
+	// one more than the number of Bounds, holds observations above every bound
+	Counts []uint64
+	// Count is the total number of observations
+	Count uint64
+	// Sum is the total of every observation
+	Sum time.Duration
+}
+
+// StatsSource is implemented by types that report Stats, such as PacketServer
+type StatsSource interface {
+	Stats() Stats
+}
+
+// serverStats tracks the counters reported by Stats
+type serverStats struct {
+	packetsReceived    uint64
+	bytesReceived      uint64
+	packetsSent        uint64
+	bytesSent          uint64
+	readErrors         uint64
+	writeErrors        uint64
+	zeroLengthPackets  uint64
+	unknownPacketTypes uint64
+	packetsHandled     uint64
+	handlerPanics      uint64
+	inFlight           int64
+	latencyCounts      [len(latencyBuckets) + 1]uint64 // one count per bucket and one for larger values
+	latencySum         int64
+}
+
+// monitor records what happens to packets sent and received on an endpoint
+// and reports events to the configured Observer and Logger. Packets received
+// by a PacketServer carry the monitor so PacketMux can report to it
+type monitor struct {
+	stats    serverStats
+	drops    dropCounter
+	observer Observer
+	logger   Logger
+}
+
+func newMonitor(options *packetOptions) *monitor {
+	return &monitor{
+		drops:    dropCounter{handler: options.DropHandler, observer: options.Observer},
+		observer: options.Observer,
+		logger:   options.Logger,
+	}
+}
+
+// received records a datagram read from the connection
+func (m *monitor) received(n int) {
+	atomic.AddUint64(&m.stats.packetsReceived, 1)
+	atomic.AddUint64(&m.stats.bytesReceived, uint64(n))
+	if n == 0 {
+		atomic.AddUint64(&m.stats.zeroLengthPackets, 1)
+	}
+}
+
+// readError records a failed read and reports whether it is permanent, in
+// which case serving stops. A read deadline expiring is expected on an idle
+// server so it is only logged at LevelDebug and not counted
+func (m *monitor) readError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		m.logger.Log(LevelDebug, "read deadline expired", "err", err)
+		return false
+	}
+	atomic.AddUint64(&m.stats.readErrors, 1)
+	m.observer.OnReadError(err)
+	if isClosedConnError(err) {
+		m.logger.Log(LevelError, "connection closed, serving stopped", "err", err)
+		return true
+	}
+	m.logger.Log(LevelWarn, "read from connection failed", "err", err)
+	return false
+}
+
+// isClosedConnError reports whether err means the connection was closed and
+// every further read fails
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, ErrDTLSConnClosed)
+}
+
+// malformed records a packet that could not be decoded
+func (m *monitor) malformed(packet Packet, err error) {
+	if m == nil {
+		return
+	}
+	m.logger.Log(LevelDebug, "malformed packet", "from", packet.FromAddr(), "err", err)
+	m.drops.drop(packet, DropReasonMalformed)
+}
+
+// corrupt records a packet that failed checksum verification
+func (m *monitor) corrupt(packet Packet, err error) {
+	if m == nil {
+		return
+	}
+	m.logger.Log(LevelDebug, "corrupt packet", "from", packet.FromAddr(), "err", err)
+	m.drops.drop(packet, DropReasonChecksum)
+}
+
+// handlerPanic records a PacketHandler panicking
+func (m *monitor) handlerPanic(packet Packet, value interface{}, stack []byte) {
+	atomic.AddUint64(&m.stats.handlerPanics, 1)
+	m.logger.Log(LevelError, "packet handler panic", "from", packet.FromAddr(), "panic", value, "stack", string(stack))
+	m.observer.OnHandlerPanic(packet, value, stack)
+}
+
+// shutdown records the server shutting down
+func (m *monitor) shutdown(err error) {
+	if err != nil {
+		m.logger.Log(LevelWarn, "packet server shut down before handlers finished", "err", err)
+	} else {
+		m.logger.Log(LevelDebug, "packet server shut down")
+	}
+	m.observer.OnShutdown(err)
+}
+
+// sent records the result of writing a datagram of n bytes
+func (m *monitor) sent(n int, err error) {
+	if err != nil {
+		atomic.AddUint64(&m.stats.writeErrors, 1)
+		return
+	}
+	atomic.AddUint64(&m.stats.packetsSent, 1)
+	atomic.AddUint64(&m.stats.bytesSent, uint64(n))
+}
+
+// unknownPacketType records a packet a PacketMux had no PacketHandler for.
+// Packets that were not received by a PacketServer do not carry a monitor
+func (m *monitor) unknownPacketType(packet Packet, pktType PacketType) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.stats.unknownPacketTypes, 1)
+	m.observer.OnUnknownType(packet, pktType)
+}
+
+// handlerStarted records a packet being handed to a PacketHandler
+func (m *monitor) handlerStarted() time.Time {
+	atomic.AddInt64(&m.stats.inFlight, 1)
+	return time.Now()
+}
+
+// handlerFinished records the PacketHandler returning
+func (m *monitor) handlerFinished(start time.Time) {
+	latency := time.Since(start)
+	atomic.AddInt64(&m.stats.inFlight, -1)
+	atomic.AddUint64(&m.stats.packetsHandled, 1)
+	atomic.AddInt64(&m.stats.latencySum, int64(latency))
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&m.stats.latencyCounts[bucket], 1)
+}
+
+// snapshot returns the current Stats
+func (m *monitor) snapshot() Stats {
+	stats := Stats{
+		PacketsReceived:    atomic.LoadUint64(&m.stats.packetsReceived),
+		BytesReceived:      atomic.LoadUint64(&m.stats.bytesReceived),
+		PacketsSent:        atomic.LoadUint64(&m.stats.packetsSent),
+		BytesSent:          atomic.LoadUint64(&m.stats.bytesSent),
+		ReadErrors:         atomic.LoadUint64(&m.stats.readErrors),
+		WriteErrors:        atomic.LoadUint64(&m.stats.writeErrors),
+		ZeroLengthPackets:  atomic.LoadUint64(&m.stats.zeroLengthPackets),
+		UnknownPacketTypes: atomic.LoadUint64(&m.stats.unknownPacketTypes),
+		PacketsHandled:     atomic.LoadUint64(&m.stats.packetsHandled),
+		HandlerPanics:      atomic.LoadUint64(&m.stats.handlerPanics),
+		InFlight:           atomic.LoadInt64(&m.stats.inFlight),
+		Dropped:            make(map[DropReason]uint64, numDropReasons),
+		HandlerLatency: Histogram{
+			Bounds: append([]time.Duration(nil), latencyBuckets[:]...),
+			Counts: make([]uint64, len(latencyBuckets)+1),
+			Sum:    time.Duration(atomic.LoadInt64(&m.stats.latencySum)),
+		},
+	}
+	for reason := 0; reason < numDropReasons; reason++ {
+		stats.Dropped[DropReason(reason)] = m.drops.count(DropReason(reason))
+	}
+	for i := range stats.HandlerLatency.Counts {
+		stats.HandlerLatency.Counts[i] = atomic.LoadUint64(&m.stats.latencyCounts[i])
+		stats.HandlerLatency.Count += stats.HandlerLatency.Counts[i]
+	}
+	return stats
+}
+
+// StatsHandler returns an http.Handler that serves the Stats of source in the
+// Prometheus text exposition format, for example
+//
+//	http.Handle("/metrics", hacket.StatsHandler(server))
+func StatsHandler(source StatsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, source.Stats())
+	})
+}
+
+// WritePrometheus writes stats to w in the Prometheus text exposition format
+func WritePrometheus(w io.Writer, stats Stats) error {
+	pw := &prometheusWriter{w: w}
+	pw.counter("hacket_packets_received_total", "Datagrams read from the connection.", stats.PacketsReceived)
+	pw.counter("hacket_bytes_received_total", "Bytes read from the connection.", stats.BytesReceived)
+	pw.counter("hacket_packets_sent_total", "Datagrams written to the connection.", stats.PacketsSent)
+	pw.counter("hacket_bytes_sent_total", "Bytes written to the connection.", stats.BytesSent)
+	pw.counter("hacket_read_errors_total", "Failed reads from the connection.", stats.ReadErrors)
+	pw.counter("hacket_write_errors_total", "Failed writes to the connection.", stats.WriteErrors)
+	pw.counter("hacket_zero_length_packets_total", "Empty datagrams discarded.", stats.ZeroLengthPackets)
+	pw.counter("hacket_unknown_packet_types_total", "Packets without a registered packet handler.", stats.UnknownPacketTypes)
+	pw.counter("hacket_packets_handled_total", "Packets handled by the packet handler.", stats.PacketsHandled)
+	pw.counter("hacket_handler_panics_total", "Packet handlers that panicked.", stats.HandlerPanics)
+	pw.printf("# HELP hacket_handlers_in_flight Packets currently being handled.\n")
+	pw.printf("# TYPE hacket_handlers_in_flight gauge\n")
+	pw.printf("hacket_handlers_in_flight %d\n", stats.InFlight)
+
+	pw.printf("# HELP hacket_packets_dropped_total Packets discarded before being handled.\n")
+	pw.printf("# TYPE hacket_packets_dropped_total counter\n")
+	for reason := 0; reason < numDropReasons; reason++ {
+		pw.printf("hacket_packets_dropped_total{reason=%q} %d\n", DropReason(reason).String(), stats.Dropped[DropReason(reason)])
+	}
+
+	h := stats.HandlerLatency
+	pw.printf("# HELP hacket_handler_duration_seconds Time taken by the packet handler.\n")
+	pw.printf("# TYPE hacket_handler_duration_seconds histogram\n")
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		if i < len(h.Counts) {
+			cumulative += h.Counts[i]
+		}
+		pw.printf("hacket_handler_duration_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), cumulative)
+	}
+	pw.printf("hacket_handler_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.Count)
+	pw.printf("hacket_handler_duration_seconds_sum %g\n", h.Sum.Seconds())
+	pw.printf("hacket_handler_duration_seconds_count %d\n", h.Count)
+	return pw.err
+}
+
+// prometheusWriter writes metrics until the first error
+type prometheusWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *prometheusWriter) printf(format string, args ...interface{}) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, format, args...)
+}
+
+func (pw *prometheusWriter) counter(name string, help string, value uint64) {
+	pw.printf("# HELP %s %s\n", name, help)
+	pw.printf("# TYPE %s counter\n", name)
+	pw.printf("%s %d\n", name, value)
+}
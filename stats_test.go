@@ -0,0 +1,78 @@
+package hacket
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	server, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating server:", err)
+	}
+	defer server.Shutdown(context.Background())
+	handled := make(chan struct{}, 2)
+	mux := NewPacketMux()
+	mux.PacketHandlerFunc(echoType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(packet.Msg(), packet.FromAddr())
+		handled <- struct{}{}
+	})
+	mux.NotFoundHandlerFunc(func(packet Packet, pw PacketWriter) {
+		handled <- struct{}{}
+	})
+	go server.Serve(mux)
+
+	echo, _ := NewPacketMessageBuilder([]byte("echo")).WithPacketType(echoType).Build()
+	unknown, _ := NewPacketMessageBuilder([]byte("unknown")).WithPacketType(PacketType(99)).Build()
+	client.WriteTo(echo, server.Addr())
+	client.WriteTo(unknown, server.Addr())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for packets")
+		}
+	}
+	// allow the last handler to return
+	time.Sleep(time.Millisecond * 10)
+
+	stats := server.Stats()
+	// the echo reply, sent without a PacketType, is received by the same server
+	if stats.PacketsSent != 3 || stats.BytesSent != uint64(len(echo)+len(unknown)+len("echo")) {
+		t.Errorf("Unexpected sent stats %d packets %d bytes", stats.PacketsSent, stats.BytesSent)
+	}
+	if stats.PacketsReceived != 3 || stats.BytesReceived != stats.BytesSent {
+		t.Errorf("Unexpected received stats %d packets %d bytes", stats.PacketsReceived, stats.BytesReceived)
+	}
+	if stats.UnknownPacketTypes != 2 {
+		t.Errorf("Expected 2 unknown packet types, counted %d", stats.UnknownPacketTypes)
+	}
+	if stats.PacketsHandled != 3 || stats.HandlerLatency.Count != 3 || stats.InFlight != 0 {
+		t.Errorf("Unexpected handler stats %+v", stats)
+	}
+	// the bounds are a copy so changing them does not change later snapshots
+	bound := stats.HandlerLatency.Bounds[0]
+	stats.HandlerLatency.Bounds[0] = time.Hour
+	if got := server.Stats().HandlerLatency.Bounds[0]; got != bound {
+		t.Errorf("Expected bound %v got %v", bound, got)
+	}
+
+	recorder := httptest.NewRecorder()
+	StatsHandler(server).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, line := range []string{
+		"hacket_packets_received_total 3",
+		"hacket_unknown_packet_types_total 2",
+		`hacket_packets_dropped_total{reason="overload"} 0`,
+		`hacket_handler_duration_seconds_bucket{le="+Inf"} 3`,
+		"hacket_handler_duration_seconds_count 3",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+}
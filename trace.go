@@ -0,0 +1,260 @@
+package hacket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// traceFrameHeaderSize is the size of the frame type, trace ID, span ID and
+// trace flags at the start of a trace frame
+const traceFrameHeaderSize = frameHeaderSize + 16 + 8 + 1
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// String returns the TraceID as lowercase hex
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the SpanID as lowercase hex
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// TraceFlagsSampled is set in SpanContext.Flags when the trace is sampled
+const TraceFlagsSampled byte = 0x01
+
+// SpanContext identifies a span and is propagated to peers in the trace
+// header. It mirrors the W3C trace context used by OpenTelemetry
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid reports whether the SpanContext has a non zero TraceID and SpanID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// IsSampled reports whether the sampled flag is set
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&TraceFlagsSampled != 0
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc. Messages written
+// with a context carrying a valid SpanContext propagate it to the peer
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the SpanContext carried by ctx
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Tracer starts spans. Adapters for tracing SDKs such as OpenTelemetry
+// implement Tracer and set it on a PacketMux with SetTracer
+type Tracer interface {
+	// Start starts a span that is a child of the SpanContext carried by ctx, if
+	// any. The returned context must carry the new span's SpanContext, set with
+	// ContextWithSpanContext, so that messages written with it continue the trace
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a unit of work started by a Tracer
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// NopTracer is a Tracer that records nothing. The SpanContext received from
+// the peer is passed through so replies continue the caller's trace
+type NopTracer struct{}
+
+// Start statifies the Tracer interface
+func (NopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	sc, _ := SpanContextFromContext(ctx)
+	return ctx, nopSpan{sc: sc}
+}
+
+type nopSpan struct {
+	sc SpanContext
+}
+
+func (s nopSpan) SpanContext() SpanContext                   { return s.sc }
+func (s nopSpan) SetAttribute(key string, value interface{}) {}
+func (s nopSpan) RecordError(err error)                      {}
+func (s nopSpan) End()                                       {}
+
+// RecordedSpan is a span finished by an InMemoryTracer
+type RecordedSpan struct {
+	Name        string
+	SpanContext SpanContext
+	// Parent is the SpanContext the span was started from, the zero value for root spans
+	Parent     SpanContext
+	Attributes map[string]interface{}
+	Errors     []error
+	Start      time.Time
+	End        time.Time
+}
+
+// InMemoryTracer is a Tracer that keeps finished spans in memory. It is intended for tests
+type InMemoryTracer struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewInMemoryTracer creates an InMemoryTracer
+func NewInMemoryTracer() *InMemoryTracer {
+	return new(InMemoryTracer)
+}
+
+// Start statifies the Tracer interface. Spans are always sampled. When no IDs
+// can be read for the span the error is recorded on it and its SpanContext is
+// left invalid, so it is not propagated
+func (t *InMemoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &inMemorySpan{tracer: t}
+	span.recorded.Name = name
+	span.recorded.Start = time.Now()
+	span.recorded.Attributes = make(map[string]interface{})
+	parent, ok := SpanContextFromContext(ctx)
+	if ok {
+		span.recorded.Parent = parent
+	}
+	sc, err := newSpanContext(parent, ok)
+	if err != nil {
+		span.recorded.Errors = append(span.recorded.Errors, err)
+		return ctx, span
+	}
+	span.recorded.SpanContext = sc
+	return ContextWithSpanContext(ctx, sc), span
+}
+
+// newSpanContext returns a sampled SpanContext with a random SpanID. It
+// continues the trace of parent when hasParent is set and starts a new trace
+// otherwise
+func newSpanContext(parent SpanContext, hasParent bool) (SpanContext, error) {
+	sc := SpanContext{Flags: TraceFlagsSampled}
+	if hasParent {
+		sc.TraceID = parent.TraceID
+	} else if _, err := rand.Read(sc.TraceID[:]); err != nil {
+		return SpanContext{}, err
+	}
+	if _, err := rand.Read(sc.SpanID[:]); err != nil {
+		return SpanContext{}, err
+	}
+	return sc, nil
+}
+
+// Spans returns the spans that have ended in the order they ended
+func (t *InMemoryTracer) Spans() []RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]RecordedSpan(nil), t.spans...)
+}
+
+// Reset discards the recorded spans
+func (t *InMemoryTracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = nil
+}
+
+type inMemorySpan struct {
+	tracer   *InMemoryTracer
+	mu       sync.Mutex
+	recorded RecordedSpan
+	ended    bool
+}
+
+func (s *inMemorySpan) SpanContext() SpanContext {
+	return s.recorded.SpanContext
+}
+
+func (s *inMemorySpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorded.Attributes[key] = value
+}
+
+func (s *inMemorySpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorded.Errors = append(s.recorded.Errors, err)
+}
+
+func (s *inMemorySpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.recorded.End = time.Now()
+	recorded := s.recorded
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, recorded)
+}
+
+// encodeTraceFrame prepends a trace frame header carrying sc to msg
+func encodeTraceFrame(sc SpanContext, msg []byte) PacketMessage {
+	frame := make([]byte, traceFrameHeaderSize+len(msg))
+	putFrameHeader(frame, frameTrace)
+	copy(frame[2:18], sc.TraceID[:])
+	copy(frame[18:26], sc.SpanID[:])
+	frame[26] = sc.Flags
+	copy(frame[traceFrameHeaderSize:], msg)
+	return frame
+}
+
+// decodeTraceFrame returns the SpanContext and the message wrapped by a trace frame
+func decodeTraceFrame(b []byte) (SpanContext, PacketMessage, error) {
+	if len(b) < traceFrameHeaderSize {
+		return SpanContext{}, nil, ErrShortPacket
+	}
+	var sc SpanContext
+	copy(sc.TraceID[:], b[2:18])
+	copy(sc.SpanID[:], b[18:26])
+	sc.Flags = b[26]
+	if !sc.IsValid() {
+		return SpanContext{}, nil, ErrInvalidSpanContext
+	}
+	return sc, b[traceFrameHeaderSize:], nil
+}
+
+// traced wraps msg in a trace frame when ctx carries a valid SpanContext. The
+// size of the added header is returned so writers can report the size of msg
+func traced(ctx context.Context, msg PacketMessage) (PacketMessage, int) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || msg == nil {
+		return msg, 0
+	}
+	return encodeTraceFrame(sc, msg), traceFrameHeaderSize
+}
+
+// writeToContext writes msg to addr propagating the SpanContext carried by ctx
+func (ep *endpoint) writeToContext(ctx context.Context, msg PacketMessage, addr net.Addr) (int, error) {
+	frame, header := traced(ctx, msg)
+	n, err := ep.writeTo(frame, addr)
+	if n >= header {
+		n -= header
+	}
+	return n, err
+}
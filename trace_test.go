@@ -0,0 +1,208 @@
+package hacket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTracePropagation(t *testing.T) {
+	const tracedType = PacketType(1)
+	peerTracer := NewInMemoryTracer()
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.SetTracer(peerTracer)
+	mux.PacketHandlerFunc(tracedType, func(packet Packet, pw PacketWriter) {
+		pw.(ContextWriter).WriteToContext(packet.Context(), packet.Msg(), packet.FromAddr())
+	})
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	go caller.Serve(NewPacketMux())
+
+	callerTracer := NewInMemoryTracer()
+	ctx, span := callerTracer.Start(context.Background(), "call")
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	msg, _ := NewPacketMessageBuilder([]byte("traced")).WithPacketType(tracedType).Build()
+	reply, err := client.(Caller).Call(ctx, msg, peer.Addr())
+	if err != nil {
+		t.Fatal("Error calling peer:", err)
+	}
+	span.End()
+
+	// The reply continues the trace of the peer's span
+	replyContext, _ := SpanContextFromContext(reply.Context())
+	reply.Release()
+	spans := peerTracer.Spans()
+	if len(spans) != 1 {
+		t.Fatal("Expected one span on the peer got", len(spans))
+	}
+	got := spans[0]
+	if got.Parent != span.SpanContext() {
+		t.Errorf("Expected parent %v got %v", span.SpanContext(), got.Parent)
+	}
+	if got.SpanContext.TraceID != span.SpanContext().TraceID {
+		t.Error("Expected peer span to continue the caller's trace")
+	}
+	if replyContext != got.SpanContext {
+		t.Errorf("Expected reply to carry the peer's span %v got %v", got.SpanContext, replyContext)
+	}
+	if got.Name != tracedType.String() || got.Attributes["hacket.packet_type"] != uint16(tracedType) {
+		t.Errorf("Unexpected span %+v", got)
+	}
+}
+
+func TestTraceWriteTo(t *testing.T) {
+	const tracedType = PacketType(1)
+	msg, _ := NewPacketMessageBuilder([]byte("traced")).WithPacketType(tracedType).Build()
+	peerTracer := NewInMemoryTracer()
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	mux := NewPacketMux()
+	mux.SetTracer(peerTracer)
+	mux.PacketHandlerFunc(tracedType, func(packet Packet, pw PacketWriter) {
+		pw.WriteTo(msg, packet.FromAddr())
+	})
+	go peer.Serve(mux)
+
+	caller, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating caller:", err)
+	}
+	defer caller.Shutdown(context.Background())
+	replies := make(chan SpanContext, 1)
+	callerMux := NewPacketMux()
+	callerMux.PacketHandlerFunc(tracedType, func(packet Packet, pw PacketWriter) {
+		sc, _ := SpanContextFromContext(packet.Context())
+		replies <- sc
+	})
+	go caller.Serve(callerMux)
+
+	// replies to calls and plain writes continue the trace of the handler's span
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := client.(Caller).Call(ctx, msg, peer.Addr())
+	if err != nil {
+		t.Fatal("Error calling peer:", err)
+	}
+	called, _ := SpanContextFromContext(reply.Context())
+	reply.Release()
+	if _, err := client.WriteTo(msg, peer.Addr()); err != nil {
+		t.Fatal("Error writing to peer:", err)
+	}
+	var written SpanContext
+	select {
+	case written = <-replies:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for reply")
+	}
+	spans := peerTracer.Spans()
+	if len(spans) != 2 {
+		t.Fatal("Expected two spans on the peer got", len(spans))
+	}
+	if called != spans[0].SpanContext {
+		t.Errorf("Expected call reply to carry the peer's span %v got %v", spans[0].SpanContext, called)
+	}
+	if written != spans[1].SpanContext {
+		t.Errorf("Expected reply to carry the peer's span %v got %v", spans[1].SpanContext, written)
+	}
+}
+
+func TestPacketMuxTracerPanic(t *testing.T) {
+	tracer := NewInMemoryTracer()
+	mux := NewPacketMux()
+	mux.SetTracer(tracer)
+	mux.PacketHandlerFunc(1, func(packet Packet, pw PacketWriter) {
+		if _, ok := SpanContextFromContext(packet.Context()); !ok {
+			t.Error("Expected handler context to carry the span")
+		}
+		panic("boom")
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic to propagate")
+			}
+		}()
+		mux.HandlePacket(newTestPacket(1, "body"), &recordingPacketWriter{})
+	}()
+	spans := tracer.Spans()
+	if len(spans) != 1 || len(spans[0].Errors) != 1 {
+		t.Fatalf("Expected one span with an error got %+v", spans)
+	}
+	if spans[0].Parent.IsValid() {
+		t.Error("Expected a root span")
+	}
+}
+
+func TestTraceFrame(t *testing.T) {
+	sc := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Flags: TraceFlagsSampled}
+	got, body, err := decodeTraceFrame(encodeTraceFrame(sc, []byte("body")))
+	if err != nil || got != sc || string(body) != "body" {
+		t.Errorf("Expected %v body got %v %s %v", sc, got, body, err)
+	}
+	if _, _, err := decodeTraceFrame(encodeTraceFrame(SpanContext{}, nil)); err != ErrInvalidSpanContext {
+		t.Error("Expected ErrInvalidSpanContext got", err)
+	}
+	if _, _, err := decodeTraceFrame([]byte{byte(frameTrace)}); err != ErrShortPacket {
+		t.Error("Expected ErrShortPacket got", err)
+	}
+}
+
+func TestWriteBatchTracePropagation(t *testing.T) {
+	const tracedType = PacketType(1)
+	peerTracer := NewInMemoryTracer()
+	peer, _, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer peer.Shutdown(context.Background())
+	handled := make(chan SpanContext, 2)
+	mux := NewPacketMux()
+	mux.SetTracer(peerTracer)
+	mux.PacketHandlerFunc(tracedType, func(packet Packet, pw PacketWriter) {
+		sc, _ := SpanContextFromContext(packet.Context())
+		handled <- sc
+	})
+	go peer.Serve(mux)
+
+	sender, client, err := New("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer sender.Shutdown(context.Background())
+
+	ctx, span := NewInMemoryTracer().Start(context.Background(), "batch")
+	defer span.End()
+	msg, _ := NewPacketMessageBuilder([]byte("traced")).WithPacketType(tracedType).Build()
+	msgs := []BatchMessage{{Msg: msg, Addr: peer.Addr(), Ctx: ctx}, {Msg: msg, Addr: peer.Addr()}}
+	if _, err := client.(BatchWriter).WriteBatch(msgs); err != nil {
+		t.Fatal("Error writing batch:", err)
+	}
+	continued := 0
+	for range msgs {
+		select {
+		case sc := <-handled:
+			if sc.TraceID == span.SpanContext().TraceID {
+				continued++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for batch")
+		}
+	}
+	if continued != 1 {
+		t.Errorf("Expected only the message with a context to continue the trace, %d did", continued)
+	}
+}
@@ -0,0 +1,110 @@
+package hacket
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Transport creates the net.PacketConn used by a PacketServer and PacketClient
+// pair. Transports are looked up by network name when calling New.
+type Transport interface {
+	Listen(network string, address string) (net.PacketConn, error)
+}
+
+// TransportFunc allows a function to be used as a Transport
+type TransportFunc func(network string, address string) (net.PacketConn, error)
+
+// Listen statifies the Transport interface
+func (tf TransportFunc) Listen(network string, address string) (net.PacketConn, error) {
+	return tf(network, address)
+}
+
+// optionsTransport is implemented by built in transports that are configured
+// with the Options passed to New
+type optionsTransport interface {
+	listenWithOptions(network string, address string, options *packetOptions) (net.PacketConn, error)
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"udp":      TransportFunc(listenUDP),
+		"udp4":     TransportFunc(listenUDP),
+		"udp6":     TransportFunc(listenUDP),
+		"unixgram": TransportFunc(listenUnixgram),
+		"dtls":     dtlsTransport{},
+		"dtls4":    dtlsTransport{},
+		"dtls6":    dtlsTransport{},
+	}
+)
+
+// RegisterTransport makes a Transport available to New under the supplied
+// network name. Registering a network name that is already in use, including
+// the built in "udp", "udp4", "udp6", "unixgram", "dtls", "dtls4" and "dtls6"
+// networks, returns ErrTransportAlreadyExists.
+func RegisterTransport(network string, transport Transport) error {
+	if transport == nil {
+		return ErrNilTransport
+	}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if _, ok := transports[network]; ok {
+		return ErrTransportAlreadyExists
+	}
+	transports[network] = transport
+	return nil
+}
+
+// lookupTransport returns the Transport registered for network
+func lookupTransport(network string) (Transport, bool) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	transport, ok := transports[network]
+	return transport, ok
+}
+
+// listenUDP binds a udp, udp4 or udp6 socket to address
+func listenUDP(network string, address string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(network, udpAddr)
+}
+
+// listenUnixgram binds a unix datagram socket to the path in address
+func listenUnixgram(network string, address string) (net.PacketConn, error) {
+	unixAddr, err := net.ResolveUnixAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram(network, unixAddr)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(address, "@") {
+		// abstract sockets do not have a file to remove
+		return conn, nil
+	}
+	return &unixgramConn{UnixConn: conn, path: address}, nil
+}
+
+// unixgramConn removes the socket file it is bound to when it is closed
+type unixgramConn struct {
+	*net.UnixConn
+	path      string
+	closeOnce sync.Once
+}
+
+// Close closes the connection and removes its socket file
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	c.closeOnce.Do(func() {
+		if rmErr := os.Remove(c.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	})
+	return err
+}
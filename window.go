@@ -0,0 +1,57 @@
+package hacket
+
+// windowSize is the number of sequence numbers behind the highest sequence
+// number seen that a slidingWindow tracks
+const windowSize = 1024
+
+// slidingWindow records which sequence numbers have been seen so duplicates
+// can be detected. Sequence numbers are expected to increase but may arrive
+// out of order or with gaps. Sequence numbers older than windowSize behind the
+// highest sequence number seen are treated as already seen.
+type slidingWindow struct {
+	highest uint64
+	bitmap  [windowSize / 64]uint64
+}
+
+// check records seq and reports whether it had not been seen before
+func (sw *slidingWindow) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > sw.highest {
+		diff := seq - sw.highest
+		if diff >= windowSize {
+			sw.bitmap = [windowSize / 64]uint64{}
+		} else {
+			for i := sw.highest + 1; i <= seq; i++ {
+				sw.clear(i)
+			}
+		}
+		sw.highest = seq
+		sw.set(seq)
+		return true
+	}
+	if sw.highest-seq >= windowSize {
+		return false
+	}
+	if sw.isSet(seq) {
+		return false
+	}
+	sw.set(seq)
+	return true
+}
+
+func (sw *slidingWindow) set(seq uint64) {
+	idx := seq % windowSize
+	sw.bitmap[idx/64] |= 1 << (idx % 64)
+}
+
+func (sw *slidingWindow) clear(seq uint64) {
+	idx := seq % windowSize
+	sw.bitmap[idx/64] &^= 1 << (idx % 64)
+}
+
+func (sw *slidingWindow) isSet(seq uint64) bool {
+	idx := seq % windowSize
+	return sw.bitmap[idx/64]&(1<<(idx%64)) != 0
+}